@@ -0,0 +1,82 @@
+package outbox
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// BackoffPolicy computes how long a record that failed to be delivered waits before its next attempt
+type BackoffPolicy interface {
+	// NextDelay returns the delay before the next attempt, given the number of attempts made so far (starting at 1)
+	NextDelay(attempts int) time.Duration
+}
+
+// BackoffFunc adapts a function to the BackoffPolicy interface
+type BackoffFunc func(attempts int) time.Duration
+
+// NextDelay calls f(attempts)
+func (f BackoffFunc) NextDelay(attempts int) time.Duration {
+	return f(attempts)
+}
+
+// ConstantBackoff waits the same Delay before every attempt
+type ConstantBackoff struct {
+	Delay time.Duration
+}
+
+// NextDelay returns the constant delay
+func (b ConstantBackoff) NextDelay(int) time.Duration {
+	return b.Delay
+}
+
+// LinearBackoff waits Initial before the second attempt and Increment more before every following attempt,
+// up to Max when Max is set
+type LinearBackoff struct {
+	Initial   time.Duration
+	Increment time.Duration
+	Max       time.Duration
+}
+
+// NextDelay returns the linearly growing delay
+func (b LinearBackoff) NextDelay(attempts int) time.Duration {
+	delay := float64(b.Initial) + float64(max(attempts-1, 0))*float64(b.Increment)
+	return capDelay(delay, b.Max)
+}
+
+// ExponentialBackoff waits Initial before the second attempt and multiplies the delay by Multiplier before every
+// following attempt, up to Max when Max is set. Jitter, between 0 and 1, randomly shortens every delay by up to that
+// fraction so that records failing together are not retried together
+type ExponentialBackoff struct {
+	Initial time.Duration
+	// Multiplier defaults to 2
+	Multiplier float64
+	Max        time.Duration
+	Jitter     float64
+}
+
+// NextDelay returns the exponentially growing delay with the configured jitter applied
+func (b ExponentialBackoff) NextDelay(attempts int) time.Duration {
+	if b.Initial <= 0 {
+		// a zero delay does not grow, and multiplying it by an overflowed +Inf would be NaN
+		return 0
+	}
+	multiplier := b.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	delay := float64(b.Initial) * math.Pow(multiplier, float64(max(attempts-1, 0)))
+	jitter := min(max(b.Jitter, 0), 1)
+	return capDelay(delay*(1-jitter*rand.Float64()), b.Max)
+}
+
+// capDelay converts delay to a time.Duration that does not exceed maxDelay, when set, or overflow
+func capDelay(delay float64, maxDelay time.Duration) time.Duration {
+	if maxDelay > 0 && delay > float64(maxDelay) {
+		return maxDelay
+	}
+	if delay >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(delay)
+}
@@ -0,0 +1,88 @@
+package outbox
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffPolicies_NextDelay(t *testing.T) {
+	tests := map[string]struct {
+		policy   BackoffPolicy
+		attempts int
+		expDelay time.Duration
+	}{
+		"Constant backoff should return the delay": {
+			policy:   ConstantBackoff{Delay: time.Second},
+			attempts: 5,
+			expDelay: time.Second,
+		},
+		"Linear backoff should start from the initial delay": {
+			policy:   LinearBackoff{Initial: time.Second, Increment: 2 * time.Second},
+			attempts: 1,
+			expDelay: time.Second,
+		},
+		"Linear backoff should add the increment per attempt": {
+			policy:   LinearBackoff{Initial: time.Second, Increment: 2 * time.Second},
+			attempts: 3,
+			expDelay: 5 * time.Second,
+		},
+		"Linear backoff should not exceed the max delay": {
+			policy:   LinearBackoff{Initial: time.Second, Increment: 2 * time.Second, Max: 4 * time.Second},
+			attempts: 3,
+			expDelay: 4 * time.Second,
+		},
+		"Exponential backoff should default to doubling the delay": {
+			policy:   ExponentialBackoff{Initial: time.Second},
+			attempts: 4,
+			expDelay: 8 * time.Second,
+		},
+		"Exponential backoff should use the multiplier": {
+			policy:   ExponentialBackoff{Initial: time.Second, Multiplier: 3},
+			attempts: 3,
+			expDelay: 9 * time.Second,
+		},
+		"Exponential backoff should not exceed the max delay": {
+			policy:   ExponentialBackoff{Initial: time.Second, Max: time.Minute},
+			attempts: 100,
+			expDelay: time.Minute,
+		},
+		"Exponential backoff without max delay should not overflow": {
+			policy:   ExponentialBackoff{Initial: time.Second},
+			attempts: 10000,
+			expDelay: math.MaxInt64,
+		},
+		"Exponential backoff without initial delay should not delay after many attempts": {
+			policy:   ExponentialBackoff{Max: time.Minute},
+			attempts: 10000,
+			expDelay: 0,
+		},
+		"Backoff func should be called with the attempts": {
+			policy: BackoffFunc(func(attempts int) time.Duration {
+				return time.Duration(attempts) * time.Minute
+			}),
+			attempts: 7,
+			expDelay: 7 * time.Minute,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.expDelay, tt.policy.NextDelay(tt.attempts))
+		})
+	}
+}
+
+func TestExponentialBackoff_NextDelay_jitter(t *testing.T) {
+	policy := ExponentialBackoff{Initial: time.Second, Jitter: 0.5}
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		delay := policy.NextDelay(3)
+		assert.GreaterOrEqual(t, delay, 2*time.Second)
+		assert.LessOrEqual(t, delay, 4*time.Second)
+		seen[delay] = true
+	}
+	assert.Greater(t, len(seen), 1)
+}
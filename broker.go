@@ -1,7 +1,56 @@
 // Package outbox provides an interface for message brokers to send Message objects
 package outbox
 
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
 // MessageBroker provides an interface for message brokers to send Message objects
 type MessageBroker interface {
-	Send(message Message) error
+	// Send delivers the message. Implementations should stop waiting for the delivery once ctx is done
+	Send(ctx context.Context, message Message) error
+}
+
+// BatchMessageBroker is a MessageBroker that can deliver multiple messages at once.
+// The record processor uses SendBatch when the dispatcher broker implements it. It sends one batch at a time,
+// so DispatcherSettings.SendWorkers does not apply
+type BatchMessageBroker interface {
+	MessageBroker
+	// SendBatch delivers the messages and returns their delivery errors in the order of messages.
+	// A nil error means that the message was delivered.
+	// The ids of the records of the messages are available with RecordIDsFromContext
+	SendBatch(ctx context.Context, messages []Message) []error
+}
+
+// recordIDKey is the context key of the id of the record whose message is being sent
+type recordIDKey struct{}
+
+// RecordIDFromContext returns the id of the outbox record whose message is sent with ctx.
+// The record processor sets it on the context of MessageBroker.Send, so that brokers can use it for deduplication.
+// It is not set for dead-letter messages and for BatchMessageBroker.SendBatch, see RecordIDsFromContext
+func RecordIDFromContext(ctx context.Context) (uuid.UUID, bool) {
+	id, ok := ctx.Value(recordIDKey{}).(uuid.UUID)
+	return id, ok
+}
+
+// ContextWithRecordID returns a copy of ctx with the record id, as set by the record processor
+func ContextWithRecordID(ctx context.Context, id uuid.UUID) context.Context {
+	return context.WithValue(ctx, recordIDKey{}, id)
+}
+
+// recordIDsKey is the context key of the ids of the records whose messages are being sent in a batch
+type recordIDsKey struct{}
+
+// RecordIDsFromContext returns the ids of the outbox records whose messages are sent with ctx, in the order of the
+// messages. The record processor sets it on the context of BatchMessageBroker.SendBatch
+func RecordIDsFromContext(ctx context.Context) ([]uuid.UUID, bool) {
+	ids, ok := ctx.Value(recordIDsKey{}).([]uuid.UUID)
+	return ids, ok
+}
+
+// ContextWithRecordIDs returns a copy of ctx with the record ids of a batch, as set by the record processor
+func ContextWithRecordIDs(ctx context.Context, ids []uuid.UUID) context.Context {
+	return context.WithValue(ctx, recordIDsKey{}, ids)
 }
@@ -0,0 +1,352 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox"
+	"github.com/pkritiotis/outbox/broker/brokertest"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServer is a local stand-in for an amqp server that keeps the published messages
+type fakeServer struct {
+	mu      sync.Mutex
+	dials   int
+	dialErr error
+	nack    bool
+	// returnCode makes the server return the published messages with the reply code when set
+	returnCode uint16
+	published  []fakePublishing
+	conns      []*fakeConnection
+}
+
+type fakePublishing struct {
+	exchange string
+	key      string
+	msg      amqp.Publishing
+}
+
+func (s *fakeServer) dial(string) (connection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dials++
+	if s.dialErr != nil {
+		return nil, s.dialErr
+	}
+	conn := &fakeConnection{server: s}
+	s.conns = append(s.conns, conn)
+	return conn, nil
+}
+
+type fakeConnection struct {
+	server   *fakeServer
+	closed   bool
+	channels []*fakeChannel
+}
+
+func (c *fakeConnection) Channel() (channel, error) {
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &fakeChannel{server: c.server}
+	c.channels = append(c.channels, ch)
+	return ch, nil
+}
+
+func (c *fakeConnection) IsClosed() bool { return c.closed }
+
+func (c *fakeConnection) Close() error {
+	c.closed = true
+	for _, ch := range c.channels {
+		_ = ch.Close()
+	}
+	return nil
+}
+
+type fakeChannel struct {
+	server  *fakeServer
+	confirm bool
+	closed  bool
+	returns chan amqp.Return
+}
+
+func (c *fakeChannel) Confirm(bool) error {
+	c.confirm = true
+	return nil
+}
+
+func (c *fakeChannel) Publish(_ context.Context, exchange, key string, msg amqp.Publishing) (confirmation, error) {
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	c.server.mu.Lock()
+	c.server.published = append(c.server.published, fakePublishing{exchange: exchange, key: key, msg: msg})
+	returnCode, acked := c.server.returnCode, c.confirm && !c.server.nack
+	c.server.mu.Unlock()
+	// like the amqp client, the return is handed over before the confirm
+	if returnCode != 0 && c.returns != nil {
+		c.returns <- amqp.Return{ReplyCode: returnCode, ReplyText: "NO_ROUTE", Exchange: exchange, RoutingKey: key, MessageId: msg.MessageId, Headers: msg.Headers}
+	}
+	return fakeConfirmation{acked: acked}, nil
+}
+
+func (c *fakeChannel) NotifyReturn(returns chan amqp.Return) chan amqp.Return {
+	c.returns = returns
+	return returns
+}
+
+func (c *fakeChannel) IsClosed() bool { return c.closed }
+
+func (c *fakeChannel) Close() error {
+	if !c.closed && c.returns != nil {
+		close(c.returns)
+	}
+	c.closed = true
+	return nil
+}
+
+type fakeConfirmation struct {
+	acked bool
+}
+
+func (f fakeConfirmation) WaitContext(ctx context.Context) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return f.acked, nil
+}
+
+func TestBroker_Send(t *testing.T) {
+	recordID := uuid.New()
+	tests := map[string]struct {
+		server      *fakeServer
+		ctx         context.Context
+		event       outbox.Message
+		expErr      error
+		expExchange string
+		expKey      string
+		expMsg      amqp.Publishing
+	}{
+		"Confirmed message should be published with its headers and message id": {
+			server: &fakeServer{},
+			ctx:    outbox.ContextWithRecordID(context.Background(), recordID),
+			event: outbox.Message{
+				Key:     "sampleKey",
+				Headers: map[string]string{"testKey": "testValue", "trace": "0"},
+				BinaryHeaders: []outbox.Header{
+					{Key: "trace", Value: []byte("1")},
+					{Key: "bin", Value: []byte{0x00}},
+				},
+				Body:  []byte("testing"),
+				Topic: "orders.created",
+			},
+			expExchange: "orders",
+			expKey:      "orders.created",
+			expMsg: amqp.Publishing{
+				Headers: amqp.Table{
+					"testKey": "testValue",
+					"trace":   []interface{}{"0", []byte("1")},
+					"bin":     []byte{0x00},
+					KeyHeader: "sampleKey",
+				},
+				DeliveryMode: amqp.Persistent,
+				MessageId:    recordID.String(),
+				Body:         []byte("testing"),
+			},
+		},
+		"Nacked message should return error": {
+			server:      &fakeServer{nack: true},
+			ctx:         context.Background(),
+			event:       outbox.Message{Body: []byte("testing"), Topic: "orders.created"},
+			expErr:      ErrNack,
+			expExchange: "orders",
+			expKey:      "orders.created",
+			expMsg: amqp.Publishing{
+				Headers:      amqp.Table{},
+				DeliveryMode: amqp.Persistent,
+				Body:         []byte("testing"),
+			},
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			b, err := newBroker(Settings{Exchange: "orders"}, tt.server.dial)
+			assert.Nil(t, err)
+
+			err = b.Send(tt.ctx, tt.event)
+
+			assert.Equal(t, tt.expErr, err)
+			if tt.expMsg.MessageId == "" && len(tt.server.published) == 1 {
+				// messages without a record get a random message id
+				assert.NotEmpty(t, tt.server.published[0].msg.MessageId)
+				tt.expMsg.MessageId = tt.server.published[0].msg.MessageId
+			}
+			if len(tt.server.published) == 1 {
+				assert.NotEmpty(t, tt.server.published[0].msg.Headers[PublishIDHeader])
+				tt.expMsg.Headers[PublishIDHeader] = tt.server.published[0].msg.Headers[PublishIDHeader]
+			}
+			assert.Equal(t, []fakePublishing{{exchange: tt.expExchange, key: tt.expKey, msg: tt.expMsg}}, tt.server.published)
+		})
+	}
+}
+
+func TestBroker_Send_returned(t *testing.T) {
+	tests := map[string]struct {
+		returnCode   uint16
+		expPermanent bool
+	}{
+		"Unroutable message should fail permanently": {
+			returnCode:   amqp.NoRoute,
+			expPermanent: true,
+		},
+		"Message returned for another reason should be retried": {
+			returnCode: amqp.NoConsumers,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			server := &fakeServer{returnCode: tt.returnCode}
+			b, err := newBroker(Settings{Exchange: "orders"}, server.dial)
+			assert.Nil(t, err)
+
+			err = b.Send(outbox.ContextWithRecordID(context.Background(), uuid.New()), outbox.Message{Body: []byte("testing"), Topic: "orders.unbound"})
+
+			assert.ErrorIs(t, err, ErrReturned)
+			assert.Equal(t, tt.expPermanent, outbox.IsPermanent(err))
+			server.returnCode = 0
+			assert.Nil(t, b.Send(context.Background(), outbox.Message{Body: []byte("testing"), Topic: "orders.created"}))
+		})
+	}
+}
+
+func TestReturns_lateReturn(t *testing.T) {
+	c := make(chan amqp.Return)
+	r := newReturns(c)
+	r.expect("first")
+	r.forget("first")
+	r.expect("retry")
+
+	c <- amqp.Return{ReplyCode: amqp.NoRoute, Headers: amqp.Table{PublishIDHeader: "first"}}
+	_, returned, err := r.take(context.Background(), "retry")
+
+	assert.Nil(t, err)
+	assert.False(t, returned)
+	r.forget("retry")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	assert.Empty(t, r.returned)
+	assert.Empty(t, r.expected)
+}
+
+func TestBroker_Send_recoversClosedChannel(t *testing.T) {
+	server := &fakeServer{}
+	b, err := newBroker(Settings{}, server.dial)
+	assert.Nil(t, err)
+	server.conns[0].channels[0].closed = true
+
+	err = b.Send(context.Background(), outbox.Message{Body: []byte("testing"), Topic: "sampleTopic"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, server.dials)
+	assert.Len(t, server.conns[0].channels, 2)
+	assert.Len(t, server.published, 1)
+}
+
+func TestBroker_Send_recoversClosedConnection(t *testing.T) {
+	server := &fakeServer{}
+	b, err := newBroker(Settings{}, server.dial)
+	assert.Nil(t, err)
+	_ = server.conns[0].Close()
+
+	err = b.Send(context.Background(), outbox.Message{Body: []byte("testing"), Topic: "sampleTopic"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, server.dials)
+	assert.Len(t, server.published, 1)
+}
+
+func TestBroker_Send_reconnectError(t *testing.T) {
+	server := &fakeServer{}
+	b, err := newBroker(Settings{}, server.dial)
+	assert.Nil(t, err)
+	_ = server.conns[0].Close()
+	server.dialErr = errors.New("connection refused")
+
+	err = b.Send(context.Background(), outbox.Message{Body: []byte("testing"), Topic: "sampleTopic"})
+
+	assert.Equal(t, server.dialErr, err)
+	assert.Empty(t, server.published)
+}
+
+func TestBroker_Send_cancelledContext(t *testing.T) {
+	server := &fakeServer{}
+	b, err := newBroker(Settings{}, server.dial)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = b.Send(ctx, outbox.Message{Body: []byte("testing"), Topic: "sampleTopic"})
+
+	assert.Equal(t, context.Canceled, err)
+	assert.Empty(t, server.published)
+}
+
+func TestNewBroker_error(t *testing.T) {
+	server := &fakeServer{dialErr: errors.New("connection refused")}
+
+	b, err := newBroker(Settings{}, server.dial)
+
+	assert.Nil(t, b)
+	assert.Equal(t, server.dialErr, err)
+}
+
+func TestBroker_Close(t *testing.T) {
+	server := &fakeServer{}
+	b, err := newBroker(Settings{}, server.dial)
+	assert.Nil(t, err)
+
+	err = b.Close()
+
+	assert.Nil(t, err)
+	assert.True(t, server.conns[0].closed)
+}
+
+func TestBroker_Conformance(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) brokertest.Harness {
+		server := &fakeServer{}
+		b, err := newBroker(Settings{}, server.dial)
+		assert.Nil(t, err)
+		return brokertest.Harness{
+			Broker: b,
+			Delivered: func(t *testing.T) []outbox.Message {
+				server.mu.Lock()
+				defer server.mu.Unlock()
+				var messages []outbox.Message
+				for _, p := range server.published {
+					event := outbox.Message{Headers: map[string]string{}, Body: p.msg.Body, Topic: p.key}
+					for k, v := range p.msg.Headers {
+						event.Headers[k] = fmt.Sprint(v)
+					}
+					if key, ok := p.msg.Headers[KeyHeader].(string); ok {
+						event.Key = key
+					}
+					messages = append(messages, event)
+				}
+				return messages
+			},
+			Fail: func(t *testing.T) {
+				server.mu.Lock()
+				defer server.mu.Unlock()
+				server.nack = true
+			},
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package amqp
+
+import (
+	"context"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// connection is the part of an amqp connection used by the Broker
+type connection interface {
+	Channel() (channel, error)
+	IsClosed() bool
+	Close() error
+}
+
+// channel is the part of an amqp channel used by the Broker
+type channel interface {
+	Confirm(noWait bool) error
+	Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) (confirmation, error)
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	IsClosed() bool
+	Close() error
+}
+
+// confirmation is the publisher confirm of a published message
+type confirmation interface {
+	WaitContext(ctx context.Context) (bool, error)
+}
+
+// amqpConnection adapts an amqp connection to the connection interface
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+func dial(url string) (connection, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return amqpConnection{conn}, nil
+}
+
+func (c amqpConnection) Channel() (channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return amqpChannel{ch}, nil
+}
+
+// amqpChannel adapts an amqp channel to the channel interface. Messages are published as mandatory, so that the
+// server returns the messages it cannot route to a queue
+type amqpChannel struct {
+	*amqp.Channel
+}
+
+func (c amqpChannel) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) (confirmation, error) {
+	confirm, err := c.Channel.PublishWithDeferredConfirmWithContext(ctx, exchange, key, true, false, msg)
+	if err != nil {
+		return nil, err
+	}
+	return confirm, nil
+}
+
+// returns keeps the mandatory messages that the server returned on a channel by publish id, see PublishIDHeader.
+// Only the returns of the expected publishes are kept, so a return that arrives after its Send gave up is dropped
+type returns struct {
+	flush chan struct{}
+	done  chan struct{}
+
+	mu       sync.Mutex
+	expected map[string]bool
+	returned map[string]amqp.Return
+}
+
+// newReturns keeps the messages received from c until c is closed, which happens when the channel is closed
+func newReturns(c <-chan amqp.Return) *returns {
+	r := &returns{
+		flush:    make(chan struct{}),
+		done:     make(chan struct{}),
+		expected: make(map[string]bool),
+		returned: make(map[string]amqp.Return),
+	}
+	go r.receive(c)
+	return r
+}
+
+// receive keeps the returned messages. Returns and flushes are received by the same goroutine, so a flush completes
+// only after the returns received before it are kept
+func (r *returns) receive(c <-chan amqp.Return) {
+	defer close(r.done)
+	for {
+		select {
+		case ret, ok := <-c:
+			if !ok {
+				return
+			}
+			id, _ := ret.Headers[PublishIDHeader].(string)
+			r.mu.Lock()
+			if r.expected[id] {
+				r.returned[id] = ret
+			}
+			r.mu.Unlock()
+		case <-r.flush:
+		}
+	}
+}
+
+// expect keeps the return of the publish with the publish id until forget is called
+func (r *returns) expect(publishID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expected[publishID] = true
+}
+
+// forget drops the return of the publish with the publish id
+func (r *returns) forget(publishID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.expected, publishID)
+	delete(r.returned, publishID)
+}
+
+// take returns the returned message of the publish with the publish id.
+// The server sends the return of a message before its publisher confirm and the amqp client hands it over before
+// handling the confirm, so take finds the return of a message that is already confirmed
+func (r *returns) take(ctx context.Context, publishID string) (amqp.Return, bool, error) {
+	select {
+	case r.flush <- struct{}{}:
+	case <-r.done:
+	case <-ctx.Done():
+		return amqp.Return{}, false, ctx.Err()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret, ok := r.returned[publishID]
+	return ret, ok, nil
+}
@@ -0,0 +1,164 @@
+// Package brokertest provides a conformance test suite for outbox.MessageBroker implementations
+package brokertest
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// Topic is the topic of the messages sent by the conformance tests
+const Topic = "outbox.conformance"
+
+// Harness is a MessageBroker under test and the means to inspect and break its delivery
+type Harness struct {
+	Broker outbox.MessageBroker
+	// Delivered returns the messages delivered so far in delivery order, as their consumers see them.
+	// The returned messages may have more headers than the sent ones, e.g. the headers the broker adds
+	Delivered func(t *testing.T) []outbox.Message
+	// Fail makes the following sends fail. The error propagation test is skipped when nil
+	Fail func(t *testing.T)
+}
+
+// Factory returns a Harness with a new broker that has not delivered any messages
+type Factory func(t *testing.T) Harness
+
+// RunConformance runs the conformance test suite against the brokers returned by factory.
+// Every test calls factory for a new broker
+func RunConformance(t *testing.T, factory Factory) {
+	tests := map[string]func(t *testing.T, factory Factory){
+		"RoundTrip":           testRoundTrip,
+		"LargeBody":           testLargeBody,
+		"EmptyKey":            testEmptyKey,
+		"ErrorPropagation":    testErrorPropagation,
+		"ConcurrentSends":     testConcurrentSends,
+		"ContextCancellation": testContextCancellation,
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			tt(t, factory)
+		})
+	}
+}
+
+// assertDelivered asserts that the delivered message has the topic, key, body and headers of the sent one
+func assertDelivered(t *testing.T, sent outbox.Message, delivered outbox.Message) {
+	assert.Equal(t, sent.Topic, delivered.Topic)
+	assert.Equal(t, sent.Key, delivered.Key)
+	assert.Equal(t, sent.Body, delivered.Body)
+	for k, v := range sent.Headers {
+		assert.Equal(t, v, delivered.Headers[k], "header %q", k)
+	}
+}
+
+func testRoundTrip(t *testing.T, factory Factory) {
+	h := factory(t)
+	sent := outbox.Message{
+		Key: "sampleKey",
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+			"X-Custom":     "value",
+		},
+		Body:  []byte(`{"id":1}`),
+		Topic: Topic,
+	}
+
+	err := h.Broker.Send(context.Background(), sent)
+
+	require.NoError(t, err)
+	delivered := h.Delivered(t)
+	require.Len(t, delivered, 1)
+	assertDelivered(t, sent, delivered[0])
+}
+
+func testLargeBody(t *testing.T, factory Factory) {
+	h := factory(t)
+	body := make([]byte, 512*1024)
+	_, err := rand.Read(body)
+	require.NoError(t, err)
+	sent := outbox.Message{Key: "sampleKey", Body: body, Topic: Topic}
+
+	err = h.Broker.Send(context.Background(), sent)
+
+	require.NoError(t, err)
+	delivered := h.Delivered(t)
+	require.Len(t, delivered, 1)
+	assertDelivered(t, sent, delivered[0])
+}
+
+func testEmptyKey(t *testing.T, factory Factory) {
+	h := factory(t)
+	sent := outbox.Message{Body: []byte("body"), Topic: Topic}
+
+	err := h.Broker.Send(context.Background(), sent)
+
+	require.NoError(t, err)
+	delivered := h.Delivered(t)
+	require.Len(t, delivered, 1)
+	assertDelivered(t, sent, delivered[0])
+}
+
+func testErrorPropagation(t *testing.T, factory Factory) {
+	h := factory(t)
+	if h.Fail == nil {
+		t.Skip("the harness cannot make the broker fail")
+	}
+	h.Fail(t)
+
+	err := h.Broker.Send(context.Background(), outbox.Message{Key: "sampleKey", Body: []byte("body"), Topic: Topic})
+
+	assert.Error(t, err)
+}
+
+func testConcurrentSends(t *testing.T, factory Factory) {
+	h := factory(t)
+	const senders, messages = 5, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, senders*messages)
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < messages; n++ {
+				errs <- h.Broker.Send(context.Background(), outbox.Message{
+					Key:   fmt.Sprintf("sender-%d", i),
+					Body:  []byte(fmt.Sprintf("%d-%d", i, n)),
+					Topic: Topic,
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	delivered := h.Delivered(t)
+	bodies := make(map[string]bool)
+	for _, msg := range delivered {
+		bodies[string(msg.Body)] = true
+	}
+	assert.Len(t, delivered, senders*messages)
+	assert.Len(t, bodies, senders*messages, "every message should be delivered once")
+}
+
+func testContextCancellation(t *testing.T, factory Factory) {
+	h := factory(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := h.Broker.Send(ctx, outbox.Message{Key: "sampleKey", Body: []byte("body"), Topic: Topic})
+
+	assert.True(t, errors.Is(err, context.Canceled), "the error should wrap context.Canceled, got %v", err)
+	assert.Empty(t, h.Delivered(t))
+}
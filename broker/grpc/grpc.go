@@ -0,0 +1,204 @@
+// Package grpc provides a message broker that streams the messages to a gRPC Receiver, and a reference Receiver
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc"
+
+	"github.com/pkritiotis/outbox"
+	"github.com/pkritiotis/outbox/broker/grpc/pb"
+)
+
+// ErrReceiver is the error of the messages that the receiver could not handle
+var ErrReceiver = errors.New("the receiver could not handle the message")
+
+// errSendBlocked fails the pending messages of a stream that is closed because a send was blocked until its context
+// was done, e.g. by the flow control of a receiver that stopped reading
+var errSendBlocked = errors.New("the stream was closed because a send was blocked")
+
+// Broker implements the MessageBroker interface by streaming the messages to a Receiver and waiting for their acks.
+// All the messages share a single stream, which is reopened by the next Send when it fails
+type Broker struct {
+	client pb.ReceiverClient
+
+	mu      sync.Mutex
+	stream  *deliverStream
+	pending map[uint64]chan result
+	nextID  uint64
+}
+
+// deliverStream is an open Deliver stream
+type deliverStream struct {
+	pb.Receiver_DeliverClient
+	cancel context.CancelFunc
+	// sending holds a token while a send of the stream is in progress, which serializes the sends
+	sending chan struct{}
+}
+
+// result is the ack of a message or the error of its stream
+type result struct {
+	resp *pb.DeliverResponse
+	err  error
+}
+
+// NewBroker constructor
+func NewBroker(conn grpc.ClientConnInterface) *Broker {
+	return &Broker{
+		client:  pb.NewReceiverClient(conn),
+		pending: make(map[uint64]chan result),
+	}
+}
+
+// Send streams the message to the receiver and waits for its ack.
+// If ctx is done while the message is blocked from being sent, the stream is closed and reopened by the next Send.
+// Errors of the receiver wrap ErrReceiver and are permanent when the receiver reports them as permanent
+func (b *Broker) Send(ctx context.Context, event outbox.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stream, id, results, err := b.register()
+	if err != nil {
+		return err
+	}
+	defer b.unregister(id)
+
+	select {
+	case stream.sending <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	sent := make(chan error, 1)
+	go func() {
+		sent <- stream.Send(request(ctx, id, event))
+		<-stream.sending
+	}()
+	select {
+	case err = <-sent:
+		if err != nil {
+			b.fail(stream, err)
+			return err
+		}
+	case <-ctx.Done():
+		// the blocked send returns when the stream is closed
+		b.fail(stream, errSendBlocked)
+		return ctx.Err()
+	}
+
+	select {
+	case res := <-results:
+		if res.err != nil {
+			return res.err
+		}
+		if res.resp.Error == "" {
+			return nil
+		}
+		err = fmt.Errorf("%w: %s", ErrReceiver, res.resp.Error)
+		if res.resp.Permanent {
+			return outbox.Permanent(err)
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close closes the stream
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	stream := b.stream
+	b.mu.Unlock()
+	if stream == nil {
+		return nil
+	}
+	var err error
+	select {
+	case stream.sending <- struct{}{}:
+		err = stream.CloseSend()
+		<-stream.sending
+	default:
+		// a send is in progress and returns when the stream is closed below
+	}
+	b.fail(stream, errors.New("the broker was closed"))
+	return err
+}
+
+// register returns the open stream, opening it when needed, and the id and the result channel of a new message
+func (b *Broker) register() (*deliverStream, uint64, chan result, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stream == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		s, err := b.client.Deliver(ctx)
+		if err != nil {
+			cancel()
+			return nil, 0, nil, err
+		}
+		b.stream = &deliverStream{Receiver_DeliverClient: s, cancel: cancel, sending: make(chan struct{}, 1)}
+		go b.receive(b.stream)
+	}
+	b.nextID++
+	results := make(chan result, 1)
+	b.pending[b.nextID] = results
+	return b.stream, b.nextID, results, nil
+}
+
+func (b *Broker) unregister(id uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.pending, id)
+}
+
+// receive passes the acks of the stream to the waiting messages until the stream fails
+func (b *Broker) receive(stream *deliverStream) {
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			b.fail(stream, err)
+			return
+		}
+		b.mu.Lock()
+		if results, ok := b.pending[resp.Id]; ok {
+			results <- result{resp: resp}
+			delete(b.pending, resp.Id)
+		}
+		b.mu.Unlock()
+	}
+}
+
+// fail closes the stream and fails its pending messages with err, so that the next Send opens a new stream
+func (b *Broker) fail(stream *deliverStream, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stream != stream {
+		return
+	}
+	stream.cancel()
+	b.stream = nil
+	for id, results := range b.pending {
+		results <- result{err: err}
+		delete(b.pending, id)
+	}
+}
+
+// request returns the DeliverRequest of the message
+func request(ctx context.Context, id uint64, event outbox.Message) *pb.DeliverRequest {
+	req := &pb.DeliverRequest{
+		Id:        id,
+		Topic:     event.Topic,
+		Key:       event.Key,
+		BinaryKey: event.BinaryKey,
+		Headers:   event.Headers,
+		Body:      event.Body,
+	}
+	if recordID, ok := outbox.RecordIDFromContext(ctx); ok {
+		req.RecordId = recordID.String()
+	}
+	for _, h := range event.BinaryHeaders {
+		req.BinaryHeaders = append(req.BinaryHeaders, &pb.Header{Key: h.Key, Value: h.Value})
+	}
+	return req
+}
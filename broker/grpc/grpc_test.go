@@ -0,0 +1,243 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox"
+	"github.com/pkritiotis/outbox/broker/brokertest"
+	"github.com/pkritiotis/outbox/broker/grpc/pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newBroker serves srv in-process with the server options over bufconn and returns a Broker connected to it
+func newBroker(t *testing.T, srv pb.ReceiverServer, opts ...grpc.ServerOption) *Broker {
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer(opts...)
+	pb.RegisterReceiverServer(s, srv)
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	b := NewBroker(conn)
+	t.Cleanup(func() {
+		_ = b.Close()
+	})
+	return b
+}
+
+// recordingHandler keeps the handled messages with their record ids and fails the messages with the provided bodies
+type recordingHandler struct {
+	mu        sync.Mutex
+	failing   map[string]error
+	messages  []outbox.Message
+	recordIDs []uuid.UUID
+}
+
+func (h *recordingHandler) handle(ctx context.Context, msg outbox.Message) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messages = append(h.messages, msg)
+	if id, ok := outbox.RecordIDFromContext(ctx); ok {
+		h.recordIDs = append(h.recordIDs, id)
+	}
+	return h.failing[string(msg.Body)]
+}
+
+func TestBroker_Send(t *testing.T) {
+	recordID := uuid.New()
+	tests := map[string]struct {
+		ctx          context.Context
+		event        outbox.Message
+		expErr       error
+		expPermanent bool
+		expRecordIDs []uuid.UUID
+	}{
+		"Acked message should be delivered with all its fields": {
+			ctx: outbox.ContextWithRecordID(context.Background(), recordID),
+			event: outbox.Message{
+				Key:           "sampleKey",
+				BinaryKey:     []byte{0x00},
+				Headers:       map[string]string{"testKey": "testValue"},
+				BinaryHeaders: []outbox.Header{{Key: "trace", Value: []byte("1")}, {Key: "trace", Value: []byte("2")}},
+				Body:          []byte("testing"),
+				Topic:         "sampleTopic",
+			},
+			expRecordIDs: []uuid.UUID{recordID},
+		},
+		"Receiver error should be returned": {
+			ctx:    context.Background(),
+			event:  outbox.Message{Body: []byte("retryable"), Topic: "sampleTopic"},
+			expErr: ErrReceiver,
+		},
+		"Permanent receiver error should be permanent": {
+			ctx:          context.Background(),
+			event:        outbox.Message{Body: []byte("permanent"), Topic: "sampleTopic"},
+			expErr:       ErrReceiver,
+			expPermanent: true,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			handler := &recordingHandler{failing: map[string]error{
+				"retryable": errors.New("unavailable"),
+				"permanent": outbox.Permanent(errors.New("invalid message")),
+			}}
+			b := newBroker(t, NewReceiver(handler.handle))
+
+			err := b.Send(tt.ctx, tt.event)
+
+			assert.ErrorIs(t, err, tt.expErr)
+			assert.Equal(t, tt.expPermanent, outbox.IsPermanent(err))
+			assert.Equal(t, []outbox.Message{tt.event}, handler.messages)
+			assert.Equal(t, tt.expRecordIDs, handler.recordIDs)
+		})
+	}
+}
+
+func TestBroker_Send_concurrent(t *testing.T) {
+	handler := &recordingHandler{}
+	b := newBroker(t, NewReceiver(handler.handle))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := b.Send(context.Background(), outbox.Message{Body: []byte(fmt.Sprint(i)), Topic: "sampleTopic"})
+			assert.Nil(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Len(t, handler.messages, 20)
+}
+
+// failingReceiver fails its first stream after receiving a message and handles the later streams with Receiver
+type failingReceiver struct {
+	pb.UnimplementedReceiverServer
+	mu      sync.Mutex
+	streams int
+	next    *Receiver
+}
+
+func (f *failingReceiver) Deliver(stream pb.Receiver_DeliverServer) error {
+	f.mu.Lock()
+	f.streams++
+	first := f.streams == 1
+	f.mu.Unlock()
+	if !first {
+		return f.next.Deliver(stream)
+	}
+	if _, err := stream.Recv(); err != nil {
+		return err
+	}
+	return errors.New("stream failed")
+}
+
+func TestBroker_Send_reopensFailedStream(t *testing.T) {
+	handler := &recordingHandler{}
+	srv := &failingReceiver{next: NewReceiver(handler.handle)}
+	b := newBroker(t, srv)
+	msg := outbox.Message{Body: []byte("testing"), Topic: "sampleTopic"}
+
+	err := b.Send(context.Background(), msg)
+	assert.ErrorContains(t, err, "stream failed")
+
+	err = b.Send(context.Background(), msg)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, srv.streams)
+	assert.Len(t, handler.messages, 1)
+}
+
+func TestBroker_Send_cancelledContext(t *testing.T) {
+	block := make(chan struct{})
+	b := newBroker(t, NewReceiver(func(ctx context.Context, _ outbox.Message) error {
+		select {
+		case <-block:
+		case <-ctx.Done():
+		}
+		return nil
+	}))
+	defer close(block)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go cancel()
+	err := b.Send(ctx, outbox.Message{Body: []byte("testing"), Topic: "sampleTopic"})
+
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestBroker_Send_blockedReceiver(t *testing.T) {
+	block := make(chan struct{})
+	handled := make(chan struct{}, 1)
+	b := newBroker(t, NewReceiver(func(ctx context.Context, _ outbox.Message) error {
+		handled <- struct{}{}
+		select {
+		case <-block:
+		case <-ctx.Done():
+		}
+		return nil
+	}), grpc.InitialWindowSize(64*1024), grpc.InitialConnWindowSize(64*1024))
+	defer close(block)
+	msg := outbox.Message{Body: make([]byte, 2*1024*1024), Topic: "sampleTopic"}
+	go func() {
+		_ = b.Send(context.Background(), msg)
+	}()
+	<-handled
+
+	// the receiver stopped reading, so the flow control blocks the sends
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := b.Send(ctx, msg)
+		cancel()
+		assert.Equal(t, context.DeadlineExceeded, err)
+	}
+}
+
+func TestBroker_Conformance(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) brokertest.Harness {
+		handler := &recordingHandler{}
+		var failing atomic.Bool
+		b := newBroker(t, NewReceiver(func(ctx context.Context, msg outbox.Message) error {
+			if failing.Load() {
+				return errors.New("unavailable")
+			}
+			return handler.handle(ctx, msg)
+		}))
+		return brokertest.Harness{
+			Broker: b,
+			Delivered: func(t *testing.T) []outbox.Message {
+				handler.mu.Lock()
+				defer handler.mu.Unlock()
+				return handler.messages
+			},
+			Fail: func(t *testing.T) {
+				failing.Store(true)
+			},
+		}
+	})
+}
@@ -0,0 +1,4 @@
+// Package pb contains the protobuf messages and the gRPC service of the outbox Receiver
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative outbox.proto
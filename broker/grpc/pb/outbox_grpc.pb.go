@@ -0,0 +1,115 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.27.1
+// source: outbox.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Receiver_Deliver_FullMethodName = "/outbox.v1.Receiver/Deliver"
+)
+
+// ReceiverClient is the client API for Receiver service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ReceiverClient interface {
+	Deliver(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[DeliverRequest, DeliverResponse], error)
+}
+
+type receiverClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewReceiverClient(cc grpc.ClientConnInterface) ReceiverClient {
+	return &receiverClient{cc}
+}
+
+func (c *receiverClient) Deliver(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[DeliverRequest, DeliverResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Receiver_ServiceDesc.Streams[0], Receiver_Deliver_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[DeliverRequest, DeliverResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Receiver_DeliverClient = grpc.BidiStreamingClient[DeliverRequest, DeliverResponse]
+
+// ReceiverServer is the server API for Receiver service.
+// All implementations must embed UnimplementedReceiverServer
+// for forward compatibility.
+type ReceiverServer interface {
+	Deliver(grpc.BidiStreamingServer[DeliverRequest, DeliverResponse]) error
+	mustEmbedUnimplementedReceiverServer()
+}
+
+// UnimplementedReceiverServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedReceiverServer struct{}
+
+func (UnimplementedReceiverServer) Deliver(grpc.BidiStreamingServer[DeliverRequest, DeliverResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Deliver not implemented")
+}
+func (UnimplementedReceiverServer) mustEmbedUnimplementedReceiverServer() {}
+func (UnimplementedReceiverServer) testEmbeddedByValue()                  {}
+
+// UnsafeReceiverServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ReceiverServer will
+// result in compilation errors.
+type UnsafeReceiverServer interface {
+	mustEmbedUnimplementedReceiverServer()
+}
+
+func RegisterReceiverServer(s grpc.ServiceRegistrar, srv ReceiverServer) {
+	// If the following call pancis, it indicates UnimplementedReceiverServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Receiver_ServiceDesc, srv)
+}
+
+func _Receiver_Deliver_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ReceiverServer).Deliver(&grpc.GenericServerStream[DeliverRequest, DeliverResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Receiver_DeliverServer = grpc.BidiStreamingServer[DeliverRequest, DeliverResponse]
+
+// Receiver_ServiceDesc is the grpc.ServiceDesc for Receiver service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Receiver_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "outbox.v1.Receiver",
+	HandlerType: (*ReceiverServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Deliver",
+			Handler:       _Receiver_Deliver_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "outbox.proto",
+}
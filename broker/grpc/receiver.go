@@ -0,0 +1,69 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/google/uuid"
+
+	"github.com/pkritiotis/outbox"
+	"github.com/pkritiotis/outbox/broker/grpc/pb"
+)
+
+// Handler handles the messages of a Receiver.
+// The record id is available with outbox.RecordIDFromContext and errors marked with outbox.Permanent are
+// reported as permanent, so a MessageBroker.Send can be used to forward the messages to another broker
+type Handler func(ctx context.Context, message outbox.Message) error
+
+// Receiver is a reference implementation of the Receiver service that handles the messages of every stream in order
+type Receiver struct {
+	pb.UnimplementedReceiverServer
+	handler Handler
+}
+
+// NewReceiver constructor
+func NewReceiver(handler Handler) *Receiver {
+	return &Receiver{handler: handler}
+}
+
+// Deliver handles the messages of the stream and acknowledges every message once it is handled
+func (r *Receiver) Deliver(stream pb.Receiver_DeliverServer) error {
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		ctx := stream.Context()
+		if recordID, parseErr := uuid.Parse(req.RecordId); parseErr == nil {
+			ctx = outbox.ContextWithRecordID(ctx, recordID)
+		}
+		resp := &pb.DeliverResponse{Id: req.Id}
+		if err = r.handler(ctx, message(req)); err != nil {
+			resp.Error = err.Error()
+			resp.Permanent = outbox.IsPermanent(err)
+		}
+		if err = stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// message returns the outbox message of the request
+func message(req *pb.DeliverRequest) outbox.Message {
+	msg := outbox.Message{
+		Key:       req.Key,
+		BinaryKey: req.BinaryKey,
+		Headers:   req.Headers,
+		Body:      req.Body,
+		Topic:     req.Topic,
+	}
+	for _, h := range req.BinaryHeaders {
+		msg.BinaryHeaders = append(msg.BinaryHeaders, outbox.Header{Key: h.Key, Value: h.Value})
+	}
+	return msg
+}
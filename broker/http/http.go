@@ -0,0 +1,218 @@
+// Package http provides an HTTP webhook message broker implementation
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+
+	"github.com/pkritiotis/outbox"
+)
+
+const (
+	// SignatureHeader is the HTTP header with the HMAC-SHA256 signature of the request, see Sign
+	SignatureHeader = "X-Outbox-Signature"
+	// TimestampHeader is the HTTP header with the unix time of the request that is part of the signature
+	TimestampHeader = "X-Outbox-Timestamp"
+	// TopicHeader is the HTTP header with the message topic
+	TopicHeader = "X-Outbox-Topic"
+	// KeyHeader is the HTTP header with the message key
+	KeyHeader = "X-Outbox-Key"
+	// RecordIDHeader is the HTTP header with the id of the outbox record, which receivers can use for deduplication
+	RecordIDHeader = "X-Outbox-Record-Id"
+)
+
+// DefaultTimeout is the request timeout used when neither Settings.Timeout nor the client timeout is set
+const DefaultTimeout = 30 * time.Second
+
+// maxErrorBodySize is the maximum number of bytes of the response body kept in a StatusError
+const maxErrorBodySize = 512
+
+// ErrUnknownTopic is returned for messages whose topic has no webhook url
+var ErrUnknownTopic = errors.New("unknown topic")
+
+// ErrInvalidHeader is returned for messages with a header name or value that cannot be sent in an HTTP request
+var ErrInvalidHeader = errors.New("invalid http header")
+
+// StatusError is returned when the webhook responds with a non 2xx status code
+type StatusError struct {
+	StatusCode int
+	// Body is the beginning of the response body
+	Body string
+}
+
+// Error returns the status error message
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webhook responded with %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// Settings contain the webhook broker settings
+type Settings struct {
+	// URL returns the webhook url of the topic
+	URL func(topic string) (string, error)
+	// Secret signs the requests with HMAC-SHA256 when set
+	Secret []byte
+	// Client sends the requests. A copy of http.DefaultClient is used when nil.
+	// Redirects are never followed, since they would resend the request as a GET without the body
+	Client *http.Client
+	// Timeout limits each request. The client timeout is used when zero, or DefaultTimeout if the client has none
+	Timeout time.Duration
+}
+
+// StaticURL returns a Settings.URL function that sends all the topics to url
+func StaticURL(url string) func(topic string) (string, error) {
+	return func(string) (string, error) {
+		return url, nil
+	}
+}
+
+// TopicURLs returns a Settings.URL function that sends every topic to its url in urls
+func TopicURLs(urls map[string]string) func(topic string) (string, error) {
+	return func(topic string) (string, error) {
+		url, ok := urls[topic]
+		if !ok {
+			return "", fmt.Errorf("%w: %q", ErrUnknownTopic, topic)
+		}
+		return url, nil
+	}
+}
+
+// Broker implements the MessageBroker interface with HTTP webhooks
+type Broker struct {
+	settings Settings
+	time     func() time.Time
+}
+
+// NewBroker constructor
+func NewBroker(settings Settings) *Broker {
+	client := http.DefaultClient
+	if settings.Client != nil {
+		client = settings.Client
+	}
+	c := *client
+	c.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	if settings.Timeout > 0 {
+		c.Timeout = settings.Timeout
+	} else if c.Timeout == 0 {
+		c.Timeout = DefaultTimeout
+	}
+	settings.Client = &c
+	return &Broker{settings: settings, time: time.Now}
+}
+
+// Send POSTs the message body to the webhook url of its topic.
+// 2xx responses are successful and 3xx responses are retried, since redirects are not followed. Other 4xx responses than 408 and 429, topics without a url and invalid headers are
+// permanent errors, see outbox.Permanent, while 5xx responses, 408, 429 and transport errors such as timeouts are retried
+func (b *Broker) Send(ctx context.Context, event outbox.Message) error {
+	url, err := b.settings.URL(event.Topic)
+	if err != nil {
+		return outbox.Permanent(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(event.Body))
+	if err != nil {
+		return outbox.Permanent(err)
+	}
+	if err = b.setHeaders(ctx, req, event); err != nil {
+		return outbox.Permanent(err)
+	}
+
+	resp, err := b.settings.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	statusErr := &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	if permanentStatus(resp.StatusCode) {
+		return outbox.Permanent(statusErr)
+	}
+	return statusErr
+}
+
+// setHeaders sets the message headers and the signature on the request.
+// It returns ErrInvalidHeader for a header that is not a valid HTTP header, e.g. a binary value with a newline
+func (b *Broker) setHeaders(ctx context.Context, req *http.Request, event outbox.Message) error {
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for k, v := range event.Headers {
+		if err := validateHeader(k, v); err != nil {
+			return err
+		}
+		req.Header.Set(k, v)
+	}
+	for _, h := range event.BinaryHeaders {
+		if err := validateHeader(h.Key, string(h.Value)); err != nil {
+			return err
+		}
+		req.Header.Add(h.Key, string(h.Value))
+	}
+	if err := validateHeader(TopicHeader, event.Topic); err != nil {
+		return err
+	}
+	req.Header.Set(TopicHeader, event.Topic)
+	if event.BinaryKey != nil {
+		if err := validateHeader(KeyHeader, string(event.BinaryKey)); err != nil {
+			return err
+		}
+		req.Header.Set(KeyHeader, string(event.BinaryKey))
+	} else if event.Key != "" {
+		if err := validateHeader(KeyHeader, event.Key); err != nil {
+			return err
+		}
+		req.Header.Set(KeyHeader, event.Key)
+	}
+	if id, ok := outbox.RecordIDFromContext(ctx); ok {
+		req.Header.Set(RecordIDHeader, id.String())
+	}
+	if len(b.settings.Secret) > 0 {
+		timestamp := strconv.FormatInt(b.time().Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, Sign(b.settings.Secret, timestamp, event.Body))
+	}
+	return nil
+}
+
+// validateHeader returns ErrInvalidHeader when name or value cannot be sent as an HTTP header
+func validateHeader(name, value string) error {
+	if !httpguts.ValidHeaderFieldName(name) {
+		return fmt.Errorf("%w name %q", ErrInvalidHeader, name)
+	}
+	if !httpguts.ValidHeaderFieldValue(value) {
+		return fmt.Errorf("%w value of %q", ErrInvalidHeader, name)
+	}
+	return nil
+}
+
+// permanentStatus reports whether the delivery must not be retried after a response with the status code
+func permanentStatus(code int) bool {
+	if code == http.StatusRequestTimeout || code == http.StatusTooManyRequests {
+		return false
+	}
+	return code >= 400 && code < 500
+}
+
+// Sign returns the SignatureHeader value of a request with the timestamp and the body.
+// The signature is the hex encoded HMAC-SHA256 of "<timestamp>.<body>" with the sha256= prefix,
+// so receivers can verify requests by comparing it with hmac.Equal
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
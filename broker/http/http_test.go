@@ -0,0 +1,308 @@
+package http
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox"
+	"github.com/pkritiotis/outbox/broker/brokertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker_Send(t *testing.T) {
+	recordID := uuid.New()
+	var (
+		gotPath   string
+		gotHeader http.Header
+		gotBody   []byte
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotHeader = r.Header
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+	b := NewBroker(Settings{
+		URL:    TopicURLs(map[string]string{"orders": srv.URL + "/hooks/orders"}),
+		Secret: []byte("secret"),
+	})
+	b.time = func() time.Time {
+		return time.Unix(1700000000, 0)
+	}
+	ctx := outbox.ContextWithRecordID(context.Background(), recordID)
+
+	err := b.Send(ctx, outbox.Message{
+		Key:           "sampleKey",
+		Headers:       map[string]string{"Content-Type": "application/json"},
+		BinaryHeaders: []outbox.Header{{Key: "X-Trace", Value: []byte("1")}, {Key: "X-Trace", Value: []byte("2")}},
+		Body:          []byte(`{"id":1}`),
+		Topic:         "orders",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "/hooks/orders", gotPath)
+	assert.Equal(t, []byte(`{"id":1}`), gotBody)
+	assert.Equal(t, "application/json", gotHeader.Get("Content-Type"))
+	assert.Equal(t, []string{"1", "2"}, gotHeader.Values("X-Trace"))
+	assert.Equal(t, "orders", gotHeader.Get(TopicHeader))
+	assert.Equal(t, "sampleKey", gotHeader.Get(KeyHeader))
+	assert.Equal(t, recordID.String(), gotHeader.Get(RecordIDHeader))
+	assert.Equal(t, "1700000000", gotHeader.Get(TimestampHeader))
+	assert.Equal(t, Sign([]byte("secret"), "1700000000", gotBody), gotHeader.Get(SignatureHeader))
+}
+
+func TestBroker_Send_statusCodes(t *testing.T) {
+	tests := map[string]struct {
+		statusCode   int
+		expErr       bool
+		expPermanent bool
+	}{
+		"200 should be successful": {
+			statusCode: http.StatusOK,
+		},
+		"204 should be successful": {
+			statusCode: http.StatusNoContent,
+		},
+		"302 should be retryable": {
+			statusCode: http.StatusFound,
+			expErr:     true,
+		},
+		"400 should be permanent": {
+			statusCode:   http.StatusBadRequest,
+			expErr:       true,
+			expPermanent: true,
+		},
+		"404 should be permanent": {
+			statusCode:   http.StatusNotFound,
+			expErr:       true,
+			expPermanent: true,
+		},
+		"408 should be retryable": {
+			statusCode: http.StatusRequestTimeout,
+			expErr:     true,
+		},
+		"429 should be retryable": {
+			statusCode: http.StatusTooManyRequests,
+			expErr:     true,
+		},
+		"500 should be retryable": {
+			statusCode: http.StatusInternalServerError,
+			expErr:     true,
+		},
+		"503 should be retryable": {
+			statusCode: http.StatusServiceUnavailable,
+			expErr:     true,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statusCode)
+				_, _ = w.Write([]byte("response body"))
+			}))
+			defer srv.Close()
+			b := NewBroker(Settings{URL: StaticURL(srv.URL)})
+
+			err := b.Send(context.Background(), outbox.Message{Body: []byte("testing"), Topic: "orders"})
+
+			if !tt.expErr {
+				assert.Nil(t, err)
+				return
+			}
+			var statusErr *StatusError
+			assert.ErrorAs(t, err, &statusErr)
+			assert.Equal(t, tt.statusCode, statusErr.StatusCode)
+			assert.Equal(t, "response body", statusErr.Body)
+			assert.Equal(t, tt.expPermanent, outbox.IsPermanent(err))
+		})
+	}
+}
+
+func TestBroker_Send_timeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	b := NewBroker(Settings{URL: StaticURL(srv.URL), Client: &http.Client{Timeout: 10 * time.Millisecond}})
+
+	err := b.Send(context.Background(), outbox.Message{Body: []byte("testing"), Topic: "orders"})
+
+	assert.NotNil(t, err)
+	assert.False(t, outbox.IsPermanent(err))
+}
+
+func TestNewBroker_timeout(t *testing.T) {
+	tests := map[string]struct {
+		settings   Settings
+		expTimeout time.Duration
+	}{
+		"Default client should use the default timeout": {
+			expTimeout: DefaultTimeout,
+		},
+		"Client without a timeout should use the default timeout": {
+			settings:   Settings{Client: &http.Client{}},
+			expTimeout: DefaultTimeout,
+		},
+		"Client timeout should be kept": {
+			settings:   Settings{Client: &http.Client{Timeout: time.Second}},
+			expTimeout: time.Second,
+		},
+		"Timeout should override the client timeout": {
+			settings:   Settings{Client: &http.Client{Timeout: time.Second}, Timeout: time.Minute},
+			expTimeout: time.Minute,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			b := NewBroker(tt.settings)
+
+			assert.Equal(t, tt.expTimeout, b.settings.Client.Timeout)
+			assert.Zero(t, http.DefaultClient.Timeout)
+		})
+	}
+}
+
+func TestBroker_Send_redirect(t *testing.T) {
+	var moved bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/moved", http.StatusFound)
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		moved = true
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	b := NewBroker(Settings{URL: StaticURL(srv.URL), Client: &http.Client{}})
+
+	err := b.Send(context.Background(), outbox.Message{Body: []byte("testing"), Topic: "orders"})
+
+	var statusErr *StatusError
+	assert.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusFound, statusErr.StatusCode)
+	assert.False(t, outbox.IsPermanent(err))
+	assert.False(t, moved)
+}
+
+func TestBroker_Send_unknownTopic(t *testing.T) {
+	b := NewBroker(Settings{URL: TopicURLs(map[string]string{})})
+
+	err := b.Send(context.Background(), outbox.Message{Body: []byte("testing"), Topic: "orders"})
+
+	assert.ErrorIs(t, err, ErrUnknownTopic)
+	assert.True(t, outbox.IsPermanent(err))
+}
+
+func TestBroker_Send_invalidHeaders(t *testing.T) {
+	tests := map[string]outbox.Message{
+		"Binary header value with a newline should not be sent": {
+			BinaryHeaders: []outbox.Header{{Key: "X-Trace", Value: []byte("1\r\nX-Injected: 1")}},
+		},
+		"Binary header value with a null byte should not be sent": {
+			BinaryHeaders: []outbox.Header{{Key: "X-Trace", Value: []byte{0x00, 0x01}}},
+		},
+		"Binary header with an invalid name should not be sent": {
+			BinaryHeaders: []outbox.Header{{Key: "X Trace", Value: []byte("1")}},
+		},
+		"Header with an invalid name should not be sent": {
+			Headers: map[string]string{"X:Trace": "1"},
+		},
+		"Binary key with a newline should not be sent": {
+			BinaryKey: []byte("key\n"),
+		},
+	}
+	for name, test := range tests {
+		msg := test
+		t.Run(name, func(t *testing.T) {
+			called := false
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			}))
+			defer srv.Close()
+			b := NewBroker(Settings{URL: StaticURL(srv.URL)})
+			msg.Body = []byte("testing")
+			msg.Topic = "orders"
+
+			err := b.Send(context.Background(), msg)
+
+			assert.ErrorIs(t, err, ErrInvalidHeader)
+			assert.True(t, outbox.IsPermanent(err))
+			assert.False(t, called)
+		})
+	}
+}
+
+func TestBroker_Send_withoutSecret(t *testing.T) {
+	var gotHeader http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = r.Header
+	}))
+	defer srv.Close()
+	b := NewBroker(Settings{URL: StaticURL(srv.URL)})
+
+	err := b.Send(context.Background(), outbox.Message{Body: []byte("testing"), Topic: "orders"})
+
+	assert.Nil(t, err)
+	assert.Empty(t, gotHeader.Get(SignatureHeader))
+	assert.Empty(t, gotHeader.Get(TimestampHeader))
+	assert.Equal(t, "application/octet-stream", gotHeader.Get("Content-Type"))
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '1700000000.testing' | openssl dgst -sha256 -hmac secret
+	assert.Equal(t, "sha256=55dab983dfd90797cd35db5e5ea2e6c0e9de34ade8f790eb29a2b3afadc7fee5", Sign([]byte("secret"), "1700000000", []byte("testing")))
+}
+
+func TestBroker_Conformance(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) brokertest.Harness {
+		var (
+			mu       sync.Mutex
+			messages []outbox.Message
+			failing  atomic.Bool
+		)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if failing.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			event := outbox.Message{
+				Key:     r.Header.Get(KeyHeader),
+				Headers: map[string]string{},
+				Body:    body,
+				Topic:   r.Header.Get(TopicHeader),
+			}
+			for k := range r.Header {
+				event.Headers[k] = r.Header.Get(k)
+			}
+			mu.Lock()
+			messages = append(messages, event)
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		t.Cleanup(srv.Close)
+		return brokertest.Harness{
+			Broker: NewBroker(Settings{URL: StaticURL(srv.URL), Secret: []byte("secret")}),
+			Delivered: func(t *testing.T) []outbox.Message {
+				mu.Lock()
+				defer mu.Unlock()
+				return messages
+			},
+			Fail: func(t *testing.T) {
+				failing.Store(true)
+			},
+		}
+	})
+}
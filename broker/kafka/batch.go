@@ -0,0 +1,177 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/IBM/sarama"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// BatchBroker implements the BatchMessageBroker interface on top of an async producer.
+// All the messages of a batch are queued to the producer at once and their results are correlated through the
+// producer message metadata
+type BatchBroker struct {
+	producer sarama.AsyncProducer
+	router   TopicRouter
+	wg       sync.WaitGroup
+	// txn serializes the transactions of a transactional producer, nil otherwise
+	txn *sync.Mutex
+}
+
+// delivery correlates a produced message with the batch that sent it
+type delivery struct {
+	index   int
+	results chan<- deliveryResult
+}
+
+// deliveryResult is the outcome of the message with the provided batch index
+type deliveryResult struct {
+	index int
+	err   error
+}
+
+// NewBatchBroker constructor
+func NewBatchBroker(brokers []string, config *sarama.Config, opts ...Option) (*BatchBroker, error) {
+	o := configure(config, opts)
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	b := newBatchBroker(producer)
+	b.router = o.router
+	if transactional(config) {
+		b.txn = &sync.Mutex{}
+	}
+	return b, nil
+}
+
+func newBatchBroker(producer sarama.AsyncProducer) *BatchBroker {
+	b := &BatchBroker{producer: producer}
+	b.wg.Add(2)
+	go func() {
+		defer b.wg.Done()
+		for msg := range producer.Successes() {
+			report(msg, nil)
+		}
+	}()
+	go func() {
+		defer b.wg.Done()
+		for pErr := range producer.Errors() {
+			report(pErr.Msg, pErr.Err)
+		}
+	}()
+	return b
+}
+
+// report sends the outcome of the message to the batch that sent it
+func report(msg *sarama.ProducerMessage, err error) {
+	d, ok := msg.Metadata.(delivery)
+	if !ok {
+		return
+	}
+	// results is buffered for the whole batch, so this never blocks
+	d.results <- deliveryResult{index: d.index, err: err}
+}
+
+// Send delivers the message to kafka
+func (b *BatchBroker) Send(ctx context.Context, event outbox.Message) error {
+	return b.SendBatch(ctx, []outbox.Message{event})[0]
+}
+
+// SendBatch queues all the messages to the async producer and waits for their results.
+// If ctx is done before kafka responds the messages without a result get the context error,
+// while they may still be delivered.
+// When the broker is transactional the batch is committed in a single transaction. If any message fails the
+// transaction is aborted and the other messages fail with ErrTransactionAborted
+func (b *BatchBroker) SendBatch(ctx context.Context, events []outbox.Message) []error {
+	if b.txn == nil {
+		return b.sendBatch(ctx, events)
+	}
+
+	b.txn.Lock()
+	defer b.txn.Unlock()
+	if err := b.producer.BeginTxn(); err != nil {
+		return batchErrors(len(events), err)
+	}
+	errs := b.sendBatch(ctx, events)
+	for _, err := range errs {
+		if err != nil {
+			return abortedErrors(errs, errors.Join(err, b.producer.AbortTxn()))
+		}
+	}
+	if err := b.producer.CommitTxn(); err != nil {
+		return batchErrors(len(events), errors.Join(err, b.producer.AbortTxn()))
+	}
+	return errs
+}
+
+// sendBatch queues all the messages to the async producer and waits for their results
+func (b *BatchBroker) sendBatch(ctx context.Context, events []outbox.Message) []error {
+	errs := make([]error, len(events))
+	results := make(chan deliveryResult, len(events))
+	pending := make(map[int]bool, len(events))
+
+	for i, event := range events {
+		if err := ctx.Err(); err != nil {
+			errs[i] = err
+			continue
+		}
+		msg, err := producerMessage(event, b.router)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		msg.Metadata = delivery{index: i, results: results}
+		select {
+		case b.producer.Input() <- msg:
+			pending[i] = true
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+		}
+	}
+
+	for len(pending) > 0 {
+		select {
+		case res := <-results:
+			errs[res.index] = res.err
+			delete(pending, res.index)
+		case <-ctx.Done():
+			for i := range pending {
+				errs[i] = ctx.Err()
+			}
+			return errs
+		}
+	}
+	return errs
+}
+
+// batchErrors returns n copies of err
+func batchErrors(n int, err error) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// abortedErrors sets the errors of the messages of an aborted transaction that did not fail on their own
+func abortedErrors(errs []error, cause error) []error {
+	for i, err := range errs {
+		if err == nil {
+			errs[i] = fmt.Errorf("%w: %w", ErrTransactionAborted, cause)
+		}
+	}
+	return errs
+}
+
+// Close flushes the queued messages and closes the producer
+func (b *BatchBroker) Close() {
+	b.producer.AsyncClose()
+	b.wg.Wait()
+}
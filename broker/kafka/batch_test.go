@@ -0,0 +1,111 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchBroker_SendBatch(t *testing.T) {
+	tests := map[string]struct {
+		events  []outbox.Message
+		expErrs []error
+	}{
+		"Successful delivery should return nil errors": {
+			events: []outbox.Message{
+				{Key: "k1", Body: []byte("1"), Topic: "sampleTopic"},
+				{Key: "k2", Body: []byte("2"), Topic: "sampleTopic"},
+				{Key: "k3", Body: []byte("3"), Topic: "sampleTopic"},
+			},
+			expErrs: []error{nil, nil, nil},
+		},
+		"Results should be correlated to their messages": {
+			events: []outbox.Message{
+				{Key: "k1", Body: []byte("1"), Topic: "sampleTopic"},
+				{Key: "k2", Body: []byte("2"), Topic: "failingTopic"},
+				{Key: "k3", Body: []byte("3"), Topic: "sampleTopic"},
+			},
+			expErrs: []error{nil, sarama.ErrBrokerNotAvailable, nil},
+		},
+		"Empty batch should return no errors": {
+			events:  []outbox.Message{},
+			expErrs: []error{},
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			mp := sarama.NewMockBroker(t, 1)
+			defer mp.Close()
+			mp.SetHandlerByMap(map[string]sarama.MockResponse{
+				"MetadataRequest": sarama.NewMockMetadataResponse(t).
+					SetBroker(mp.Addr(), mp.BrokerID()).
+					SetLeader("sampleTopic", 0, mp.BrokerID()).
+					SetLeader("failingTopic", 0, mp.BrokerID()),
+				"ProduceRequest": sarama.NewMockProduceResponse(t).
+					SetError("failingTopic", 0, sarama.ErrBrokerNotAvailable),
+			})
+			config := sarama.NewConfig()
+			config.Producer.Retry.Max = 0
+			b, err := NewBatchBroker([]string{mp.Addr()}, config)
+			assert.Nil(t, err)
+			defer b.Close()
+
+			errs := b.SendBatch(context.Background(), tt.events)
+
+			assert.Equal(t, tt.expErrs, errs)
+		})
+	}
+}
+
+func TestBatchBroker_SendBatch_cancelledContext(t *testing.T) {
+	mp := sarama.NewMockBroker(t, 1)
+	defer mp.Close()
+	mp.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(mp.Addr(), mp.BrokerID()).
+			SetLeader("sampleTopic", 0, mp.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t),
+	})
+	b, err := NewBatchBroker([]string{mp.Addr()}, sarama.NewConfig())
+	assert.Nil(t, err)
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	errs := b.SendBatch(ctx, []outbox.Message{{Key: "sampleKey", Body: []byte("testing"), Topic: "sampleTopic"}})
+
+	assert.Equal(t, []error{context.Canceled}, errs)
+}
+
+func TestBatchBroker_Send(t *testing.T) {
+	mp := sarama.NewMockBroker(t, 1)
+	defer mp.Close()
+	mp.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(mp.Addr(), mp.BrokerID()).
+			SetLeader("sampleTopic", 0, mp.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetError("sampleTopic", 0, sarama.ErrBrokerNotAvailable),
+	})
+	config := sarama.NewConfig()
+	config.Producer.Retry.Max = 0
+	b, err := NewBatchBroker([]string{mp.Addr()}, config)
+	assert.Nil(t, err)
+	defer b.Close()
+
+	err = b.Send(context.Background(), outbox.Message{Key: "sampleKey", Body: []byte("testing"), Topic: "sampleTopic"})
+
+	assert.Equal(t, sarama.ErrBrokerNotAvailable, err)
+}
+
+func TestNewBatchBroker_error(t *testing.T) {
+	expErr := sarama.ConfigurationError("You must provide at least one broker address")
+
+	b, err := NewBatchBroker([]string{}, sarama.NewConfig())
+
+	assert.Nil(t, b)
+	assert.Equal(t, expErr, err)
+}
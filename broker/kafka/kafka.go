@@ -2,6 +2,11 @@
 package kafka
 
 import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
 	"github.com/IBM/sarama"
 
 	"github.com/pkritiotis/outbox"
@@ -10,35 +15,125 @@ import (
 // Broker implements the MessageBroker interface
 type Broker struct {
 	producer sarama.SyncProducer
+	router   TopicRouter
+	// txn serializes the transactions of a transactional producer, nil otherwise
+	txn *sync.Mutex
 }
 
 // NewBroker constructor
-func NewBroker(brokers []string, config *sarama.Config) (*Broker, error) {
+func NewBroker(brokers []string, config *sarama.Config, opts ...Option) (*Broker, error) {
+	o := configure(config, opts)
 	config.Producer.Return.Successes = true
 	producer, err := sarama.NewSyncProducer(brokers, config)
 	if err != nil {
 		return nil, err
 	}
-	return &Broker{producer: producer}, nil
+	b := &Broker{producer: producer, router: o.router}
+	if transactional(config) {
+		b.txn = &sync.Mutex{}
+	}
+	return b, nil
 }
 
-// Send delivers the message to kafka
-func (b Broker) Send(event outbox.Message) error {
-	var headers []sarama.RecordHeader
+// Send delivers the message to kafka, in a transaction of its own when the broker is transactional.
+// The sync producer cannot abort an in-flight request, so if ctx is done before kafka responds
+// Send returns the context error while the message may still be delivered
+func (b Broker) Send(ctx context.Context, event outbox.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	msg, err := producerMessage(event, b.router)
+	if err != nil {
+		return err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- b.produce(msg)
+	}()
 
-	for k, v := range event.Headers {
-		headers = append(headers, sarama.RecordHeader{
-			Key:   sarama.ByteEncoder(k),
-			Value: sarama.ByteEncoder(v),
-		})
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// produce sends the message with the sync producer, wrapping it in a transaction when the broker is transactional
+func (b Broker) produce(msg *sarama.ProducerMessage) error {
+	if b.txn == nil {
+		_, _, err := b.producer.SendMessage(msg)
+		return err
+	}
+
+	b.txn.Lock()
+	defer b.txn.Unlock()
+	if err := b.producer.BeginTxn(); err != nil {
+		return err
+	}
+	if _, _, err := b.producer.SendMessage(msg); err != nil {
+		return errors.Join(err, b.producer.AbortTxn())
+	}
+	if err := b.producer.CommitTxn(); err != nil {
+		return errors.Join(err, b.producer.AbortTxn())
 	}
+	return nil
+}
+
+// producerMessage returns the kafka message of the outbox message, with the topic mapped by router when set
+func producerMessage(event outbox.Message, router TopicRouter) (*sarama.ProducerMessage, error) {
+	topic := event.Topic
+	if router != nil {
+		var err error
+		if topic, err = router(event.Topic); err != nil {
+			return nil, err
+		}
+	}
+	partition := unassignedPartition
+	if event.Partition != nil {
+		partition = *event.Partition
+	}
+	return &sarama.ProducerMessage{
+		Topic:     topic,
+		Key:       messageKey(event),
+		Value:     sarama.ByteEncoder(event.Body),
+		Headers:   messageHeaders(event),
+		Partition: partition,
+	}, nil
+}
 
-	msg := &sarama.ProducerMessage{
-		Topic: event.Topic,
-		Key:   sarama.StringEncoder(event.Key),
-		Value: sarama.StringEncoder(event.Body),
+// messageKey returns the kafka key of the message. Messages without a key get a nil key
+func messageKey(event outbox.Message) sarama.Encoder {
+	if event.BinaryKey != nil {
+		return sarama.ByteEncoder(event.BinaryKey)
+	}
+	if event.Key == "" {
+		return nil
 	}
-	_, _, err := b.producer.SendMessage(msg)
+	return sarama.StringEncoder(event.Key)
+}
 
-	return err
+// messageHeaders returns the kafka headers of the message, with Headers sorted by key followed by BinaryHeaders
+func messageHeaders(event outbox.Message) []sarama.RecordHeader {
+	keys := make([]string, 0, len(event.Headers))
+	for k := range event.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	headers := make([]sarama.RecordHeader, 0, len(event.Headers)+len(event.BinaryHeaders))
+	for _, k := range keys {
+		headers = append(headers, sarama.RecordHeader{
+			Key:   []byte(k),
+			Value: []byte(event.Headers[k]),
+		})
+	}
+	for _, h := range event.BinaryHeaders {
+		headers = append(headers, sarama.RecordHeader{
+			Key:   []byte(h.Key),
+			Value: h.Value,
+		})
+	}
+	return headers
 }
@@ -1,11 +1,20 @@
 package kafka
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
 	"testing"
 
 	"github.com/IBM/sarama"
 	"github.com/pkritiotis/outbox"
+	"github.com/pkritiotis/outbox/broker/brokertest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBroker_Send(t *testing.T) {
@@ -52,12 +61,119 @@ func TestBroker_Send(t *testing.T) {
 			b := Broker{
 				producer: producer,
 			}
-			err = b.Send(tt.event)
+			err = b.Send(context.Background(), tt.event)
 			assert.Equal(t, tt.expErr, err)
 		})
 	}
 }
 
+func TestBroker_Send_recordContents(t *testing.T) {
+	tests := map[string]struct {
+		event      outbox.Message
+		expKey     []byte
+		expHeaders []sarama.RecordHeader
+	}{
+		"Headers and string key should be produced": {
+			event: outbox.Message{
+				Key:     "sampleKey",
+				Headers: map[string]string{"b": "2", "a": "1"},
+				Body:    []byte("testing"),
+				Topic:   "sampleTopic",
+			},
+			expKey: []byte("sampleKey"),
+			expHeaders: []sarama.RecordHeader{
+				{Key: []byte("a"), Value: []byte("1")},
+				{Key: []byte("b"), Value: []byte("2")},
+			},
+		},
+		"Multi-valued binary headers should be produced after headers": {
+			event: outbox.Message{
+				Key:     "sampleKey",
+				Headers: map[string]string{"a": "1"},
+				BinaryHeaders: []outbox.Header{
+					{Key: "trace", Value: []byte{0x00, 0xff}},
+					{Key: "trace", Value: []byte{0x01}},
+				},
+				Body:  []byte("testing"),
+				Topic: "sampleTopic",
+			},
+			expKey: []byte("sampleKey"),
+			expHeaders: []sarama.RecordHeader{
+				{Key: []byte("a"), Value: []byte("1")},
+				{Key: []byte("trace"), Value: []byte{0x00, 0xff}},
+				{Key: []byte("trace"), Value: []byte{0x01}},
+			},
+		},
+		"Binary key should be produced instead of key": {
+			event: outbox.Message{
+				Key:       "sampleKey",
+				BinaryKey: []byte{0x00, 0x01},
+				Body:      []byte("testing"),
+				Topic:     "sampleTopic",
+			},
+			expKey:     []byte{0x00, 0x01},
+			expHeaders: []sarama.RecordHeader{},
+		},
+		"Empty key should be produced as nil key": {
+			event: outbox.Message{
+				Body:  []byte("testing"),
+				Topic: "sampleTopic",
+			},
+			expKey:     nil,
+			expHeaders: []sarama.RecordHeader{},
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			mp, tap := newTappedBroker(t)
+			defer mp.Close()
+			mp.SetHandlerByMap(map[string]sarama.MockResponse{
+				"MetadataRequest": sarama.NewMockMetadataResponse(t).
+					SetBroker(mp.Addr(), mp.BrokerID()).
+					SetLeader("sampleTopic", 0, mp.BrokerID()),
+				"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(3),
+			})
+			config := sarama.NewConfig()
+			config.Version = sarama.V0_11_0_0
+			b, err := NewBroker([]string{mp.Addr()}, config)
+			assert.Nil(t, err)
+
+			err = b.Send(context.Background(), tt.event)
+
+			assert.Nil(t, err)
+			assert.Equal(t, []wireRecord{{
+				Topic:   tt.event.Topic,
+				Key:     tt.expKey,
+				Value:   tt.event.Body,
+				Headers: tt.expHeaders,
+			}}, tap.records())
+		})
+	}
+}
+
+func TestBroker_Send_cancelledContext(t *testing.T) {
+	mp := sarama.NewMockBroker(t, 1)
+	defer mp.Close()
+	mp.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(mp.Addr(), mp.BrokerID()).
+			SetLeader("sampleTopic", 0, mp.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t),
+	})
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	producer, err := sarama.NewSyncProducer([]string{mp.Addr()}, config)
+	assert.Nil(t, err)
+	b := Broker{producer: producer}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = b.Send(ctx, outbox.Message{Key: "sampleKey", Body: []byte("testing"), Topic: "sampleTopic"})
+
+	assert.Equal(t, context.Canceled, err)
+}
+
 func TestNewBroker_error(t *testing.T) {
 	expErr := sarama.ConfigurationError("You must provide at least one broker address")
 
@@ -83,3 +199,354 @@ func TestNewBroker_success(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, b)
 }
+
+// wiretap is the listener of a sarama.MockBroker that decodes the produce requests and responses on the wire, and
+// keeps the records of the partitions that the mock broker acknowledged without an error.
+// It decodes the v3 produce requests with uncompressed v2 record batches that sarama sends from Kafka 0.11
+type wiretap struct {
+	net.Listener
+	t *testing.T
+
+	mu       sync.Mutex
+	produced []wireRecord
+}
+
+// wireRecord is a record of a produce request as it was sent on the wire
+type wireRecord struct {
+	Topic     string
+	Partition int32
+	Key       []byte
+	Value     []byte
+	Headers   []sarama.RecordHeader
+}
+
+// newTappedBroker returns a mock broker whose connections are decoded by the returned wiretap
+func newTappedBroker(t *testing.T) (*sarama.MockBroker, *wiretap) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	w := &wiretap{Listener: l, t: t}
+	return sarama.NewMockBrokerListener(t, 1, w), w
+}
+
+func (w *wiretap) Accept() (net.Conn, error) {
+	conn, err := w.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tappedConn{Conn: conn, tap: w, pending: make(map[int32][]wireRecord)}, nil
+}
+
+// records returns the acknowledged records in the order of their responses
+func (w *wiretap) records() []wireRecord {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	records := make([]wireRecord, len(w.produced))
+	copy(records, w.produced)
+	return records
+}
+
+// messages returns the acknowledged records as messages
+func (w *wiretap) messages() []outbox.Message {
+	var messages []outbox.Message
+	for _, rec := range w.records() {
+		msg := outbox.Message{Key: string(rec.Key), Body: rec.Value, Topic: rec.Topic, Headers: map[string]string{}}
+		for _, h := range rec.Headers {
+			msg.Headers[string(h.Key)] = string(h.Value)
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+// tappedConn decodes the frames read from and written to a mock broker connection. The records of a produce request
+// are pending by correlation id until its response is written
+type tappedConn struct {
+	net.Conn
+	tap *wiretap
+
+	read    []byte
+	written []byte
+	pending map[int32][]wireRecord
+}
+
+func (c *tappedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read = append(c.read, p[:n]...)
+	for {
+		frame, ok := nextFrame(&c.read)
+		if !ok {
+			break
+		}
+		c.decodeRequest(frame)
+	}
+	return n, err
+}
+
+func (c *tappedConn) Write(p []byte) (int, error) {
+	c.written = append(c.written, p...)
+	for {
+		frame, ok := nextFrame(&c.written)
+		if !ok {
+			break
+		}
+		c.decodeResponse(frame)
+	}
+	return c.Conn.Write(p)
+}
+
+// nextFrame removes and returns the first size delimited frame of buf when it is complete
+func nextFrame(buf *[]byte) ([]byte, bool) {
+	if len(*buf) < 4 {
+		return nil, false
+	}
+	size := int(binary.BigEndian.Uint32(*buf))
+	if len(*buf) < 4+size {
+		return nil, false
+	}
+	frame := (*buf)[4 : 4+size]
+	*buf = (*buf)[4+size:]
+	return frame, true
+}
+
+// decodeRequest keeps the records of a produce request
+func (c *tappedConn) decodeRequest(frame []byte) {
+	r := &wireReader{b: frame}
+	apiKey, version, correlationID := r.int16(), r.int16(), r.int32()
+	r.nullableString() // client id
+	if apiKey != 0 {
+		return
+	}
+	if version != 3 {
+		c.tap.t.Errorf("unsupported produce request version %d", version)
+		return
+	}
+	r.nullableString() // transactional id
+	r.int16()          // acks
+	r.int32()          // timeout
+	var records []wireRecord
+	for topics := r.int32(); topics > 0; topics-- {
+		topic := r.string()
+		for partitions := r.int32(); partitions > 0; partitions-- {
+			partition := r.int32()
+			batches := &wireReader{b: r.bytes(int(r.int32()))}
+			for len(batches.b) > 0 && batches.err == nil {
+				records = append(records, batches.recordBatch(topic, partition)...)
+			}
+			r.err = errors.Join(r.err, batches.err)
+		}
+	}
+	if r.err != nil {
+		c.tap.t.Errorf("invalid produce request: %v", r.err)
+		return
+	}
+	c.pending[correlationID] = records
+}
+
+// decodeResponse acknowledges the records of the partitions that a produce response has no error for
+func (c *tappedConn) decodeResponse(frame []byte) {
+	r := &wireReader{b: frame}
+	correlationID := r.int32()
+	records, ok := c.pending[correlationID]
+	if !ok {
+		return
+	}
+	delete(c.pending, correlationID)
+	type topicPartition struct {
+		topic     string
+		partition int32
+	}
+	failed := make(map[topicPartition]bool)
+	for topics := r.int32(); topics > 0; topics-- {
+		topic := r.string()
+		for partitions := r.int32(); partitions > 0; partitions-- {
+			partition := r.int32()
+			if sarama.KError(r.int16()) != sarama.ErrNoError {
+				failed[topicPartition{topic: topic, partition: partition}] = true
+			}
+			r.int64() // base offset
+			r.int64() // log append time
+		}
+	}
+	if r.err != nil {
+		c.tap.t.Errorf("invalid produce response: %v", r.err)
+		return
+	}
+	c.tap.mu.Lock()
+	defer c.tap.mu.Unlock()
+	for _, rec := range records {
+		if !failed[topicPartition{topic: rec.Topic, partition: rec.Partition}] {
+			c.tap.produced = append(c.tap.produced, rec)
+		}
+	}
+}
+
+// wireReader reads the big-endian and varint fields of the kafka protocol, keeping the first error
+type wireReader struct {
+	b   []byte
+	err error
+}
+
+func (r *wireReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 {
+		return nil
+	}
+	if n > len(r.b) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *wireReader) int8() int8 {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int8(b[0])
+}
+
+func (r *wireReader) int16() int16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(b))
+}
+
+func (r *wireReader) int32() int32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+func (r *wireReader) int64() int64 {
+	b := r.bytes(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (r *wireReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *wireReader) string() string {
+	return string(r.bytes(int(r.int16())))
+}
+
+func (r *wireReader) nullableString() {
+	r.bytes(int(r.int16()))
+}
+
+// varbytes reads varint length delimited bytes, nil for a null value
+func (r *wireReader) varbytes() []byte {
+	n := r.varint()
+	if n < 0 {
+		return nil
+	}
+	b := r.bytes(int(n))
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// recordBatch reads a v2 record batch of the topic partition
+func (r *wireReader) recordBatch(topic string, partition int32) []wireRecord {
+	r.int64() // base offset
+	batch := &wireReader{b: r.bytes(int(r.int32()))}
+	batch.int32() // partition leader epoch
+	if magic := batch.int8(); magic != 2 && batch.err == nil {
+		batch.err = fmt.Errorf("unsupported record batch magic %d", magic)
+	}
+	batch.int32() // crc
+	if compression := batch.int16() & 0x7; compression != 0 && batch.err == nil {
+		batch.err = fmt.Errorf("unsupported record batch compression %d", compression)
+	}
+	batch.int32() // last offset delta
+	batch.int64() // first timestamp
+	batch.int64() // max timestamp
+	batch.int64() // producer id
+	batch.int16() // producer epoch
+	batch.int32() // base sequence
+	var records []wireRecord
+	for count := batch.int32(); count > 0 && batch.err == nil; count-- {
+		rec := &wireReader{b: batch.bytes(int(batch.varint()))}
+		rec.int8()   // attributes
+		rec.varint() // timestamp delta
+		rec.varint() // offset delta
+		record := wireRecord{Topic: topic, Partition: partition, Key: rec.varbytes(), Value: rec.varbytes(), Headers: []sarama.RecordHeader{}}
+		for headers := rec.varint(); headers > 0 && rec.err == nil; headers-- {
+			record.Headers = append(record.Headers, sarama.RecordHeader{Key: rec.varbytes(), Value: rec.varbytes()})
+		}
+		batch.err = errors.Join(batch.err, rec.err)
+		records = append(records, record)
+	}
+	r.err = errors.Join(r.err, batch.err)
+	return records
+}
+
+// conformanceHarness returns the harness of the broker that newBroker creates for a mock kafka broker.
+// The delivered messages are the records that the mock kafka broker acknowledged
+func conformanceHarness(t *testing.T, newBroker func(addr string, config *sarama.Config) outbox.MessageBroker) brokertest.Harness {
+	mp, tap := newTappedBroker(t)
+	t.Cleanup(mp.Close)
+	metadata := sarama.NewMockMetadataResponse(t).
+		SetBroker(mp.Addr(), mp.BrokerID()).
+		SetLeader(brokertest.Topic, 0, mp.BrokerID())
+	mp.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": metadata,
+		"ProduceRequest":  sarama.NewMockProduceResponse(t).SetVersion(3),
+	})
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_11_0_0
+	return brokertest.Harness{
+		Broker: newBroker(mp.Addr(), config),
+		Delivered: func(t *testing.T) []outbox.Message {
+			return tap.messages()
+		},
+		Fail: func(t *testing.T) {
+			mp.SetHandlerByMap(map[string]sarama.MockResponse{
+				"MetadataRequest": metadata,
+				"ProduceRequest": sarama.NewMockProduceResponse(t).
+					SetVersion(3).
+					SetError(brokertest.Topic, 0, sarama.ErrInvalidMessage),
+			})
+		},
+	}
+}
+
+func TestBroker_Conformance(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) brokertest.Harness {
+		return conformanceHarness(t, func(addr string, config *sarama.Config) outbox.MessageBroker {
+			b, err := NewBroker([]string{addr}, config)
+			require.NoError(t, err)
+			return b
+		})
+	})
+}
+
+func TestBatchBroker_Conformance(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) brokertest.Harness {
+		return conformanceHarness(t, func(addr string, config *sarama.Config) outbox.MessageBroker {
+			b, err := NewBatchBroker([]string{addr}, config)
+			require.NoError(t, err)
+			t.Cleanup(b.Close)
+			return b
+		})
+	})
+}
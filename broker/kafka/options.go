@@ -0,0 +1,78 @@
+package kafka
+
+import (
+	"errors"
+
+	"github.com/IBM/sarama"
+)
+
+// ErrTransactionAborted is returned for the messages of an aborted kafka transaction
+var ErrTransactionAborted = errors.New("the kafka transaction was aborted")
+
+// Option configures a Broker or a BatchBroker
+type Option func(o *options)
+
+// options contain the configuration of a Broker or a BatchBroker
+type options struct {
+	config *sarama.Config
+	router TopicRouter
+}
+
+// WithTransactions enables the idempotent transactional producer with the TransactionalID of machineID.
+// Every Send of a Broker and every SendBatch of a BatchBroker is committed to kafka in its own transaction,
+// so either all the messages of a batch become visible to read_committed consumers or none of them.
+// machineID must be the machineID of the dispatcher and unique across replicas, otherwise the replicas fence each other
+func WithTransactions(machineID string) Option {
+	return func(o *options) {
+		config := o.config
+		config.Producer.Idempotent = true
+		config.Producer.Transaction.ID = TransactionalID(machineID)
+		config.Producer.RequiredAcks = sarama.WaitForAll
+		config.Net.MaxOpenRequests = 1
+		if !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+			config.Version = sarama.V0_11_0_0
+		}
+	}
+}
+
+// WithTopicPartitioner sets the partitioner of the messages of topic that do not have a Message.Partition.
+// topic is the kafka topic after routing. The other topics keep using the partitioner of the config
+func WithTopicPartitioner(topic string, partitioner sarama.PartitionerConstructor) Option {
+	return func(o *options) {
+		fallback := o.config.Producer.Partitioner
+		o.config.Producer.Partitioner = func(t string) sarama.Partitioner {
+			if t == topic {
+				return partitioner(t)
+			}
+			return fallback(t)
+		}
+	}
+}
+
+// WithTopicRouter sets the router that maps Message.Topic to the kafka topic before producing.
+// Messages whose topic cannot be routed fail with the error of the router
+func WithTopicRouter(router TopicRouter) Option {
+	return func(o *options) {
+		o.router = router
+	}
+}
+
+// TransactionalID returns the kafka transactional.id used for the dispatcher with the provided machineID
+func TransactionalID(machineID string) string {
+	return "outbox-" + machineID
+}
+
+// configure applies the options to the config and makes the producer honour Message.Partition
+func configure(config *sarama.Config, opts []Option) options {
+	o := options{config: config}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	config.Producer.Partitioner = newMessagePartitioner(config.Producer.Partitioner)
+	return o
+}
+
+// transactional reports whether the config uses the transactional producer
+func transactional(config *sarama.Config) bool {
+	return config.Producer.Transaction.ID != ""
+}
@@ -0,0 +1,151 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTransactionalMockBroker returns a mock broker that acts as the transaction coordinator of machineID
+func newTransactionalMockBroker(t *testing.T, machineID string) *sarama.MockBroker {
+	mp := sarama.NewMockBroker(t, 1)
+	mp.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(mp.Addr(), mp.BrokerID()).
+			SetController(mp.BrokerID()).
+			SetLeader("sampleTopic", 0, mp.BrokerID()).
+			SetLeader("failingTopic", 0, mp.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorTransaction, TransactionalID(machineID), mp),
+		"InitProducerIDRequest": sarama.NewMockInitProducerIDResponse(t).SetProducerID(1),
+		"AddPartitionsToTxnRequest": sarama.NewMockWrapper(&sarama.AddPartitionsToTxnResponse{
+			Errors: map[string][]*sarama.PartitionError{
+				"sampleTopic":  {{Partition: 0}},
+				"failingTopic": {{Partition: 0}},
+			},
+		}),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).
+			SetVersion(3).
+			SetError("failingTopic", 0, sarama.ErrMessageSizeTooLarge),
+		"EndTxnRequest": sarama.NewMockWrapper(&sarama.EndTxnResponse{}),
+	})
+	return mp
+}
+
+// transactionalConfig returns a config with the protocol version of the mock transactional responses
+func transactionalConfig() *sarama.Config {
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_11_0_0
+	return config
+}
+
+// endTxnRequests returns the TransactionResult of the EndTxn requests received by the mock broker
+func endTxnRequests(mp *sarama.MockBroker) []bool {
+	var results []bool
+	for _, rr := range mp.History() {
+		if req, ok := rr.Request.(*sarama.EndTxnRequest); ok {
+			results = append(results, req.TransactionResult)
+		}
+	}
+	return results
+}
+
+func TestWithTransactions(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_10_0_0
+
+	configure(config, []Option{WithTransactions("machine-1")})
+
+	assert.True(t, config.Producer.Idempotent)
+	assert.Equal(t, "outbox-machine-1", config.Producer.Transaction.ID)
+	assert.Equal(t, sarama.WaitForAll, config.Producer.RequiredAcks)
+	assert.Equal(t, 1, config.Net.MaxOpenRequests)
+	assert.Equal(t, sarama.V0_11_0_0, config.Version)
+	assert.Nil(t, config.Validate())
+}
+
+func TestBroker_Send_transactional(t *testing.T) {
+	tests := map[string]struct {
+		topic     string
+		expErr    error
+		expEndTxn []bool
+	}{
+		"Successful delivery should commit the transaction": {
+			topic:     "sampleTopic",
+			expEndTxn: []bool{true},
+		},
+		"Unsuccessful delivery should abort the transaction": {
+			topic:     "failingTopic",
+			expErr:    sarama.ErrMessageSizeTooLarge,
+			expEndTxn: []bool{false},
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			mp := newTransactionalMockBroker(t, "machine-1")
+			defer mp.Close()
+			b, err := NewBroker([]string{mp.Addr()}, transactionalConfig(), WithTransactions("machine-1"))
+			assert.Nil(t, err)
+
+			err = b.Send(context.Background(), outbox.Message{Key: "sampleKey", Body: []byte("testing"), Topic: tt.topic})
+
+			if tt.expErr != nil {
+				assert.ErrorIs(t, err, tt.expErr)
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, tt.expEndTxn, endTxnRequests(mp))
+		})
+	}
+}
+
+func TestBatchBroker_SendBatch_transactional(t *testing.T) {
+	tests := map[string]struct {
+		events    []outbox.Message
+		expErrs   []error
+		expEndTxn []bool
+	}{
+		"Successful delivery should commit the batch in a single transaction": {
+			events: []outbox.Message{
+				{Key: "k1", Body: []byte("1"), Topic: "sampleTopic"},
+				{Key: "k2", Body: []byte("2"), Topic: "sampleTopic"},
+			},
+			expErrs:   []error{nil, nil},
+			expEndTxn: []bool{true},
+		},
+		"A failed message should abort the transaction of the batch": {
+			events: []outbox.Message{
+				{Key: "k1", Body: []byte("1"), Topic: "sampleTopic"},
+				{Key: "k2", Body: []byte("2"), Topic: "failingTopic"},
+			},
+			expErrs:   []error{ErrTransactionAborted, sarama.ErrMessageSizeTooLarge},
+			expEndTxn: []bool{false},
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			mp := newTransactionalMockBroker(t, "machine-1")
+			defer mp.Close()
+			b, err := NewBatchBroker([]string{mp.Addr()}, transactionalConfig(), WithTransactions("machine-1"))
+			assert.Nil(t, err)
+			defer b.Close()
+
+			errs := b.SendBatch(context.Background(), tt.events)
+
+			assert.Len(t, errs, len(tt.expErrs))
+			for i, expErr := range tt.expErrs {
+				if expErr != nil {
+					assert.ErrorIs(t, errs[i], expErr)
+				} else {
+					assert.Nil(t, errs[i])
+				}
+			}
+			assert.Equal(t, tt.expEndTxn, endTxnRequests(mp))
+		})
+	}
+}
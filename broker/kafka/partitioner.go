@@ -0,0 +1,44 @@
+package kafka
+
+import "github.com/IBM/sarama"
+
+// unassignedPartition is the partition of the producer messages without a Message.Partition
+const unassignedPartition int32 = -1
+
+// messagePartitioner sends the messages with a Message.Partition to that partition, like sarama's manual
+// partitioner, and the rest of the messages to the partition chosen by the wrapped partitioner
+type messagePartitioner struct {
+	partitioner sarama.Partitioner
+}
+
+// newMessagePartitioner returns a partitioner constructor that wraps the partitioners of constructor
+func newMessagePartitioner(constructor sarama.PartitionerConstructor) sarama.PartitionerConstructor {
+	return func(topic string) sarama.Partitioner {
+		return messagePartitioner{partitioner: constructor(topic)}
+	}
+}
+
+// Partition returns the assigned partition of the message, or the partition of the wrapped partitioner
+func (p messagePartitioner) Partition(message *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	if message.Partition != unassignedPartition {
+		return message.Partition, nil
+	}
+	return p.partitioner.Partition(message, numPartitions)
+}
+
+// RequiresConsistency reports whether the wrapped partitioner requires consistency
+func (p messagePartitioner) RequiresConsistency() bool {
+	return p.partitioner.RequiresConsistency()
+}
+
+// MessageRequiresConsistency reports whether the message has to be retried on the same partition.
+// Messages with an assigned partition always do
+func (p messagePartitioner) MessageRequiresConsistency(message *sarama.ProducerMessage) bool {
+	if message.Partition != unassignedPartition {
+		return true
+	}
+	if dynamic, ok := p.partitioner.(sarama.DynamicConsistencyPartitioner); ok {
+		return dynamic.MessageRequiresConsistency(message)
+	}
+	return p.partitioner.RequiresConsistency()
+}
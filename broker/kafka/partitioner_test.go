@@ -0,0 +1,96 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+)
+
+// fixedPartitioner sends every message to the same partition
+type fixedPartitioner int32
+
+func (f fixedPartitioner) Partition(*sarama.ProducerMessage, int32) (int32, error) {
+	return int32(f), nil
+}
+
+func (f fixedPartitioner) RequiresConsistency() bool {
+	return true
+}
+
+func fixedPartitionerConstructor(partition int32) sarama.PartitionerConstructor {
+	return func(string) sarama.Partitioner {
+		return fixedPartitioner(partition)
+	}
+}
+
+func TestMessagePartitioner(t *testing.T) {
+	partition := func(p int32) *int32 {
+		return &p
+	}
+	tests := map[string]struct {
+		event        outbox.Message
+		expPartition int32
+		expErr       error
+	}{
+		"Message partition should be used when set": {
+			event:        outbox.Message{Topic: "sampleTopic", Body: []byte("testing"), Partition: partition(2)},
+			expPartition: 2,
+		},
+		"Message partition 0 should be used when set": {
+			event:        outbox.Message{Topic: "otherTopic", Body: []byte("testing"), Partition: partition(0)},
+			expPartition: 0,
+		},
+		"Topic partitioner should be used without a message partition": {
+			event:        outbox.Message{Topic: "sampleTopic", Body: []byte("testing")},
+			expPartition: 1,
+		},
+		"Config partitioner should be used for the other topics": {
+			event:        outbox.Message{Topic: "otherTopic", Body: []byte("testing")},
+			expPartition: 2,
+		},
+		"Out of range message partition should return error": {
+			event:  outbox.Message{Topic: "sampleTopic", Body: []byte("testing"), Partition: partition(3)},
+			expErr: sarama.ErrInvalidPartition,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			mp := sarama.NewMockBroker(t, 1)
+			defer mp.Close()
+			metadata := sarama.NewMockMetadataResponse(t).SetBroker(mp.Addr(), mp.BrokerID())
+			for p := int32(0); p < 3; p++ {
+				metadata.SetLeader("sampleTopic", p, mp.BrokerID()).SetLeader("otherTopic", p, mp.BrokerID())
+			}
+			mp.SetHandlerByMap(map[string]sarama.MockResponse{
+				"MetadataRequest": metadata,
+				"ProduceRequest":  sarama.NewMockProduceResponse(t),
+			})
+			config := sarama.NewConfig()
+			config.Producer.Return.Successes = true
+			config.Producer.Partitioner = fixedPartitionerConstructor(2)
+			configure(config, []Option{WithTopicPartitioner("sampleTopic", fixedPartitionerConstructor(1))})
+			producer, err := sarama.NewSyncProducer([]string{mp.Addr()}, config)
+			assert.Nil(t, err)
+			defer producer.Close()
+
+			msg, err := producerMessage(tt.event, nil)
+			assert.Nil(t, err)
+			p, _, err := producer.SendMessage(msg)
+
+			assert.Equal(t, tt.expErr, err)
+			if tt.expErr == nil {
+				assert.Equal(t, tt.expPartition, p)
+			}
+		})
+	}
+}
+
+func TestMessagePartitioner_MessageRequiresConsistency(t *testing.T) {
+	p := newMessagePartitioner(sarama.NewRandomPartitioner)("sampleTopic").(sarama.DynamicConsistencyPartitioner)
+
+	assert.True(t, p.MessageRequiresConsistency(&sarama.ProducerMessage{Partition: 0}))
+	assert.False(t, p.MessageRequiresConsistency(&sarama.ProducerMessage{Partition: unassignedPartition}))
+}
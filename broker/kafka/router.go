@@ -0,0 +1,87 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// ErrUnknownTopic is returned by a TopicRouter for topics it cannot route
+var ErrUnknownTopic = errors.New("unknown topic")
+
+// TopicRouter maps the logical Message.Topic to the kafka topic the message is produced to.
+// Routers return an error wrapping ErrUnknownTopic for the topics they cannot route
+type TopicRouter func(topic string) (string, error)
+
+// TopicPrefix returns a TopicRouter that prepends prefix to every topic
+func TopicPrefix(prefix string) TopicRouter {
+	return func(topic string) (string, error) {
+		return prefix + topic, nil
+	}
+}
+
+// TopicSuffix returns a TopicRouter that appends suffix to every topic
+func TopicSuffix(suffix string) TopicRouter {
+	return func(topic string) (string, error) {
+		return topic + suffix, nil
+	}
+}
+
+// TopicMap returns a TopicRouter that maps the topics with the provided logical to kafka topic map
+func TopicMap(topics map[string]string) TopicRouter {
+	return func(topic string) (string, error) {
+		routed, ok := topics[topic]
+		if !ok {
+			return "", unknownTopic(topic)
+		}
+		return routed, nil
+	}
+}
+
+// TopicRegexp returns a TopicRouter that rewrites the topics matching re with the replacement template,
+// as in regexp.Regexp.ReplaceAllString
+func TopicRegexp(re *regexp.Regexp, replacement string) TopicRouter {
+	return func(topic string) (string, error) {
+		if !re.MatchString(topic) {
+			return "", unknownTopic(topic)
+		}
+		return re.ReplaceAllString(topic, replacement), nil
+	}
+}
+
+// ChainTopicRouters returns a TopicRouter that applies the routers in order, each one to the result of the previous
+func ChainTopicRouters(routers ...TopicRouter) TopicRouter {
+	return func(topic string) (string, error) {
+		for _, router := range routers {
+			var err error
+			if topic, err = router(topic); err != nil {
+				return "", err
+			}
+		}
+		return topic, nil
+	}
+}
+
+// FirstTopicRouter returns a TopicRouter that uses the first of the routers that knows the topic
+func FirstTopicRouter(routers ...TopicRouter) TopicRouter {
+	return func(topic string) (string, error) {
+		for _, router := range routers {
+			routed, err := router(topic)
+			if !errors.Is(err, ErrUnknownTopic) {
+				return routed, err
+			}
+		}
+		return "", unknownTopic(topic)
+	}
+}
+
+// DefaultTopic returns a TopicRouter that sends the topics unknown to router to defaultTopic instead of failing
+func DefaultTopic(router TopicRouter, defaultTopic string) TopicRouter {
+	return FirstTopicRouter(router, func(string) (string, error) {
+		return defaultTopic, nil
+	})
+}
+
+func unknownTopic(topic string) error {
+	return fmt.Errorf("%w: %q", ErrUnknownTopic, topic)
+}
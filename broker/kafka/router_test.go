@@ -0,0 +1,158 @@
+package kafka
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopicRouter(t *testing.T) {
+	tests := map[string]struct {
+		router   TopicRouter
+		topic    string
+		expTopic string
+		expErr   error
+	}{
+		"Prefix should prepend the prefix": {
+			router:   TopicPrefix("prod."),
+			topic:    "orders",
+			expTopic: "prod.orders",
+		},
+		"Suffix should append the suffix": {
+			router:   TopicSuffix(".v1"),
+			topic:    "orders",
+			expTopic: "orders.v1",
+		},
+		"Map should map known topics": {
+			router:   TopicMap(map[string]string{"orders": "orders-topic"}),
+			topic:    "orders",
+			expTopic: "orders-topic",
+		},
+		"Map should fail for unknown topics": {
+			router: TopicMap(map[string]string{"orders": "orders-topic"}),
+			topic:  "payments",
+			expErr: ErrUnknownTopic,
+		},
+		"Regexp should rewrite matching topics": {
+			router:   TopicRegexp(regexp.MustCompile(`^(\w+)\.events$`), "prod-$1"),
+			topic:    "orders.events",
+			expTopic: "prod-orders",
+		},
+		"Regexp should fail for topics that do not match": {
+			router: TopicRegexp(regexp.MustCompile(`^(\w+)\.events$`), "prod-$1"),
+			topic:  "orders",
+			expErr: ErrUnknownTopic,
+		},
+		"Chain should apply the routers in order": {
+			router:   ChainTopicRouters(TopicMap(map[string]string{"orders": "orders-topic"}), TopicPrefix("prod.")),
+			topic:    "orders",
+			expTopic: "prod.orders-topic",
+		},
+		"Chain should fail when a router fails": {
+			router: ChainTopicRouters(TopicMap(map[string]string{"orders": "orders-topic"}), TopicPrefix("prod.")),
+			topic:  "payments",
+			expErr: ErrUnknownTopic,
+		},
+		"First should use the first router that knows the topic": {
+			router: FirstTopicRouter(
+				TopicMap(map[string]string{"orders": "orders-topic"}),
+				TopicMap(map[string]string{"payments": "payments-topic"}),
+			),
+			topic:    "payments",
+			expTopic: "payments-topic",
+		},
+		"Default topic should be used for unknown topics": {
+			router:   DefaultTopic(TopicMap(map[string]string{"orders": "orders-topic"}), "unrouted"),
+			topic:    "payments",
+			expTopic: "unrouted",
+		},
+		"Default topic should not be used for known topics": {
+			router:   DefaultTopic(TopicMap(map[string]string{"orders": "orders-topic"}), "unrouted"),
+			topic:    "orders",
+			expTopic: "orders-topic",
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			topic, err := tt.router(tt.topic)
+
+			assert.ErrorIs(t, err, tt.expErr)
+			assert.Equal(t, tt.expTopic, topic)
+		})
+	}
+}
+
+func TestBroker_Send_topicRouter(t *testing.T) {
+	tests := map[string]struct {
+		topic    string
+		expTopic string
+		expErr   error
+	}{
+		"Routed topic should be produced": {
+			topic:    "orders",
+			expTopic: "prod.orders",
+		},
+		"Unknown topic should return error without producing": {
+			topic:  "payments",
+			expErr: ErrUnknownTopic,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			mp, tap := newTappedBroker(t)
+			defer mp.Close()
+			mp.SetHandlerByMap(map[string]sarama.MockResponse{
+				"MetadataRequest": sarama.NewMockMetadataResponse(t).
+					SetBroker(mp.Addr(), mp.BrokerID()).
+					SetLeader("prod.orders", 0, mp.BrokerID()),
+				"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(3),
+			})
+			config := sarama.NewConfig()
+			config.Version = sarama.V0_11_0_0
+			router := ChainTopicRouters(TopicMap(map[string]string{"orders": "orders"}), TopicPrefix("prod."))
+			b, err := NewBroker([]string{mp.Addr()}, config, WithTopicRouter(router))
+			assert.Nil(t, err)
+
+			err = b.Send(context.Background(), outbox.Message{Key: "sampleKey", Body: []byte("testing"), Topic: tt.topic})
+
+			assert.ErrorIs(t, err, tt.expErr)
+			if tt.expErr == nil {
+				records := tap.records()
+				require.Len(t, records, 1)
+				assert.Equal(t, tt.expTopic, records[0].Topic)
+			} else {
+				assert.Empty(t, tap.records())
+			}
+		})
+	}
+}
+
+func TestBatchBroker_SendBatch_topicRouter(t *testing.T) {
+	mp := sarama.NewMockBroker(t, 1)
+	defer mp.Close()
+	mp.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(mp.Addr(), mp.BrokerID()).
+			SetLeader("prod.orders", 0, mp.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t),
+	})
+	router := TopicMap(map[string]string{"orders": "prod.orders"})
+	b, err := NewBatchBroker([]string{mp.Addr()}, sarama.NewConfig(), WithTopicRouter(router))
+	assert.Nil(t, err)
+	defer b.Close()
+
+	errs := b.SendBatch(context.Background(), []outbox.Message{
+		{Body: []byte("1"), Topic: "orders"},
+		{Body: []byte("2"), Topic: "payments"},
+	})
+
+	assert.Nil(t, errs[0])
+	assert.ErrorIs(t, errs[1], ErrUnknownTopic)
+}
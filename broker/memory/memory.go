@@ -0,0 +1,93 @@
+// Package memory provides an in-memory message broker for tests and local development
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// Broker implements a thread-safe in-memory MessageBroker that keeps the delivered messages
+type Broker struct {
+	mu          sync.Mutex
+	messages    []outbox.Message
+	subscribers []chan outbox.Message
+	fail        func(message outbox.Message) error
+}
+
+// NewBroker constructor
+func NewBroker() *Broker {
+	return &Broker{}
+}
+
+// Send delivers the message, unless the function set with FailWith returns an error for it.
+// Send blocks while a subscriber channel is full and returns the context error if ctx is done before any subscriber received the message.
+// Once a subscriber received it the message counts as delivered and the remaining subscribers receive it in the background,
+// so a retry never delivers it twice
+func (b *Broker) Send(ctx context.Context, message outbox.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	fail := b.fail
+	subscribers := make([]chan outbox.Message, len(b.subscribers))
+	copy(subscribers, b.subscribers)
+	b.mu.Unlock()
+	if fail != nil {
+		if err := fail(message); err != nil {
+			return err
+		}
+	}
+	for i, ch := range subscribers {
+		select {
+		case ch <- message:
+		case <-ctx.Done():
+			if i == 0 {
+				return ctx.Err()
+			}
+			go deliver(subscribers[i:], message)
+			b.record(message)
+			return nil
+		}
+	}
+	b.record(message)
+	return nil
+}
+
+func (b *Broker) record(message outbox.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.messages = append(b.messages, message)
+}
+
+func deliver(subscribers []chan outbox.Message, message outbox.Message) {
+	for _, ch := range subscribers {
+		ch <- message
+	}
+}
+
+// Messages returns the delivered messages in delivery order
+func (b *Broker) Messages() []outbox.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	messages := make([]outbox.Message, len(b.messages))
+	copy(messages, b.messages)
+	return messages
+}
+
+// Subscribe returns a channel with buffer size that receives the messages delivered from now on
+func (b *Broker) Subscribe(size int) <-chan outbox.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan outbox.Message, size)
+	b.subscribers = append(b.subscribers, ch)
+	return ch
+}
+
+// FailWith sets a function that returns the delivery error of a message, or nil to deliver it
+func (b *Broker) FailWith(fail func(message outbox.Message) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fail = fail
+}
@@ -0,0 +1,106 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/pkritiotis/outbox"
+	"github.com/pkritiotis/outbox/broker/brokertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker_Send(t *testing.T) {
+	sampleErr := errors.New("failed")
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := map[string]struct {
+		ctx         context.Context
+		fail        func(outbox.Message) error
+		subscribers int
+		expErr      error
+		expMessages int
+	}{
+		"Message should be delivered": {
+			ctx:         context.Background(),
+			subscribers: 2,
+			expMessages: 1,
+		},
+		"Failure should not deliver the message": {
+			ctx: context.Background(),
+			fail: func(outbox.Message) error {
+				return sampleErr
+			},
+			expErr: sampleErr,
+		},
+		"Cancelled context should fail with the context error": {
+			ctx:         canceled,
+			subscribers: 1,
+			expErr:      context.Canceled,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			b := NewBroker()
+			b.FailWith(tt.fail)
+			var subscriptions []<-chan outbox.Message
+			for i := 0; i < tt.subscribers; i++ {
+				size := 1
+				if tt.expErr != nil {
+					size = 0
+				}
+				subscriptions = append(subscriptions, b.Subscribe(size))
+			}
+			msg := outbox.Message{Topic: "topic", Body: []byte("body")}
+
+			err := b.Send(tt.ctx, msg)
+
+			assert.Equal(t, tt.expErr, err)
+			assert.Len(t, b.Messages(), tt.expMessages)
+			if tt.expMessages > 0 {
+				for _, ch := range subscriptions {
+					assert.Equal(t, msg, <-ch)
+				}
+			}
+		})
+	}
+}
+
+func TestBroker_Conformance(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) brokertest.Harness {
+		b := NewBroker()
+		return brokertest.Harness{
+			Broker: b,
+			Delivered: func(t *testing.T) []outbox.Message {
+				return b.Messages()
+			},
+			Fail: func(t *testing.T) {
+				b.FailWith(func(outbox.Message) error {
+					return errors.New("failed")
+				})
+			},
+		}
+	})
+}
+
+func TestBroker_Send_fullSubscriber(t *testing.T) {
+	b := NewBroker()
+	first := b.Subscribe(1)
+	second := b.Subscribe(0)
+	msg := outbox.Message{Topic: "topic", Body: []byte("body")}
+	ctx, cancel := context.WithCancel(context.Background())
+	sent := make(chan error)
+	go func() {
+		sent <- b.Send(ctx, msg)
+	}()
+
+	assert.Equal(t, msg, <-first)
+	assert.Empty(t, b.Messages())
+	b.Subscribe(0)
+	cancel()
+
+	assert.Nil(t, <-sent)
+	assert.Equal(t, []outbox.Message{msg}, b.Messages())
+	assert.Equal(t, msg, <-second)
+}
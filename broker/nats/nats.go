@@ -0,0 +1,102 @@
+// Package nats provides a NATS JetStream message broker implementation
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"golang.org/x/net/http/httpguts"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// KeyHeader is the NATS header with the message key, since NATS messages do not have a key
+const KeyHeader = "Outbox-Key"
+
+// ErrInvalidHeader is returned for messages with a header name or value that cannot be sent in a NATS message,
+// e.g. a binary value with a newline
+var ErrInvalidHeader = errors.New("invalid nats header")
+
+// Broker implements the MessageBroker interface with NATS JetStream
+type Broker struct {
+	js      jetstream.JetStream
+	subject func(topic string) string
+}
+
+// Option configures a Broker
+type Option func(b *Broker)
+
+// WithSubject sets the function that maps Message.Topic to the subject the message is published to.
+// The topic is used as the subject by default
+func WithSubject(subject func(topic string) string) Option {
+	return func(b *Broker) {
+		b.subject = subject
+	}
+}
+
+// NewBroker constructor
+func NewBroker(js jetstream.JetStream, opts ...Option) *Broker {
+	b := &Broker{
+		js: js,
+		subject: func(topic string) string {
+			return topic
+		},
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Send publishes the message to the subject of its topic and waits for the JetStream publish ack.
+// The id of the outbox record is sent in the Nats-Msg-Id header, so the stream drops the messages that are sent
+// again within its duplicate window. Invalid headers are permanent errors, see outbox.Permanent
+func (b *Broker) Send(ctx context.Context, event outbox.Message) error {
+	msg := nats.NewMsg(b.subject(event.Topic))
+	msg.Data = event.Body
+	for k, v := range event.Headers {
+		if err := validateHeader(k, v); err != nil {
+			return outbox.Permanent(err)
+		}
+		msg.Header.Set(k, v)
+	}
+	for _, h := range event.BinaryHeaders {
+		if err := validateHeader(h.Key, string(h.Value)); err != nil {
+			return outbox.Permanent(err)
+		}
+		msg.Header.Add(h.Key, string(h.Value))
+	}
+	if event.BinaryKey != nil {
+		if err := validateHeader(KeyHeader, string(event.BinaryKey)); err != nil {
+			return outbox.Permanent(err)
+		}
+		msg.Header.Set(KeyHeader, string(event.BinaryKey))
+	} else if event.Key != "" {
+		if err := validateHeader(KeyHeader, event.Key); err != nil {
+			return outbox.Permanent(err)
+		}
+		msg.Header.Set(KeyHeader, event.Key)
+	}
+
+	var opts []jetstream.PublishOpt
+	if id, ok := outbox.RecordIDFromContext(ctx); ok {
+		opts = append(opts, jetstream.WithMsgID(id.String()))
+	}
+	_, err := b.js.PublishMsg(ctx, msg, opts...)
+	return err
+}
+
+// validateHeader returns ErrInvalidHeader when name or value cannot be sent as a header, which NATS encodes like
+// HTTP headers
+func validateHeader(name, value string) error {
+	if !httpguts.ValidHeaderFieldName(name) {
+		return fmt.Errorf("%w name %q", ErrInvalidHeader, name)
+	}
+	if !httpguts.ValidHeaderFieldValue(value) {
+		return fmt.Errorf("%w value of %q", ErrInvalidHeader, name)
+	}
+	return nil
+}
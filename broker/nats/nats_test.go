@@ -0,0 +1,230 @@
+package nats
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkritiotis/outbox"
+	"github.com/pkritiotis/outbox/broker/brokertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newJetStream starts an embedded nats-server with JetStream and a stream for the orders.> subjects
+func newJetStream(t *testing.T) jetstream.JetStream {
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	require.NoError(t, err)
+	go srv.Start()
+	require.True(t, srv.ReadyForConnections(5*time.Second))
+	t.Cleanup(srv.Shutdown)
+
+	nc, err := nats.Connect(srv.ClientURL())
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+	_, err = js.CreateStream(context.Background(), jetstream.StreamConfig{
+		Name:       "ORDERS",
+		Subjects:   []string{"orders.>"},
+		Duplicates: time.Minute,
+	})
+	require.NoError(t, err)
+	return js
+}
+
+// lastMessage returns the last message of the ORDERS stream
+func lastMessage(t *testing.T, js jetstream.JetStream) *jetstream.RawStreamMsg {
+	stream, err := js.Stream(context.Background(), "ORDERS")
+	require.NoError(t, err)
+	info, err := stream.Info(context.Background())
+	require.NoError(t, err)
+	msg, err := stream.GetMsg(context.Background(), info.State.LastSeq)
+	require.NoError(t, err)
+	return msg
+}
+
+func TestBroker_Send(t *testing.T) {
+	recordID := uuid.New()
+	tests := map[string]struct {
+		ctx        context.Context
+		opts       []Option
+		event      outbox.Message
+		expSubject string
+		expHeader  nats.Header
+	}{
+		"Message should be published with its headers and key": {
+			ctx: context.Background(),
+			event: outbox.Message{
+				Key:     "sampleKey",
+				Headers: map[string]string{"testKey": "testValue"},
+				BinaryHeaders: []outbox.Header{
+					{Key: "trace", Value: []byte("1")},
+					{Key: "trace", Value: []byte("2")},
+				},
+				Body:  []byte("testing"),
+				Topic: "orders.created",
+			},
+			expSubject: "orders.created",
+			expHeader: nats.Header{
+				"testKey": {"testValue"},
+				"trace":   {"1", "2"},
+				KeyHeader: {"sampleKey"},
+			},
+		},
+		"Record id should be published as the message id": {
+			ctx:        outbox.ContextWithRecordID(context.Background(), recordID),
+			event:      outbox.Message{Body: []byte("testing"), Topic: "orders.created"},
+			expSubject: "orders.created",
+			expHeader: nats.Header{
+				jetstream.MsgIDHeader: {recordID.String()},
+			},
+		},
+		"Subject should be mapped from the topic": {
+			ctx: context.Background(),
+			opts: []Option{WithSubject(func(topic string) string {
+				return "orders." + topic
+			})},
+			event:      outbox.Message{Body: []byte("testing"), Topic: "created"},
+			expSubject: "orders.created",
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			js := newJetStream(t)
+			b := NewBroker(js, tt.opts...)
+
+			err := b.Send(tt.ctx, tt.event)
+
+			assert.Nil(t, err)
+			msg := lastMessage(t, js)
+			assert.Equal(t, tt.expSubject, msg.Subject)
+			assert.Equal(t, tt.event.Body, msg.Data)
+			for k, v := range tt.expHeader {
+				assert.Equal(t, v, msg.Header.Values(k))
+			}
+		})
+	}
+}
+
+func TestBroker_Send_deduplicatesRecords(t *testing.T) {
+	js := newJetStream(t)
+	b := NewBroker(js)
+	ctx := outbox.ContextWithRecordID(context.Background(), uuid.New())
+	msg := outbox.Message{Body: []byte("testing"), Topic: "orders.created"}
+
+	assert.Nil(t, b.Send(ctx, msg))
+	assert.Nil(t, b.Send(ctx, msg))
+
+	stream, err := js.Stream(context.Background(), "ORDERS")
+	require.NoError(t, err)
+	info, err := stream.Info(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), info.State.Msgs)
+}
+
+func TestBroker_Send_noStream(t *testing.T) {
+	js := newJetStream(t)
+	b := NewBroker(js)
+
+	err := b.Send(context.Background(), outbox.Message{Body: []byte("testing"), Topic: "payments.created"})
+
+	assert.ErrorIs(t, err, jetstream.ErrNoStreamResponse)
+}
+
+func TestBroker_Send_invalidHeaders(t *testing.T) {
+	tests := map[string]outbox.Message{
+		"Binary header value with a newline should not be published": {
+			BinaryHeaders: []outbox.Header{{Key: "trace", Value: []byte("1\r\ninjected: 1")}},
+		},
+		"Binary header with an invalid name should not be published": {
+			BinaryHeaders: []outbox.Header{{Key: "trace id", Value: []byte("1")}},
+		},
+		"Header value with a newline should not be published": {
+			Headers: map[string]string{"trace": "1\n"},
+		},
+		"Binary key with a newline should not be published": {
+			BinaryKey: []byte("key\r\n"),
+		},
+	}
+	for name, test := range tests {
+		msg := test
+		t.Run(name, func(t *testing.T) {
+			js := newJetStream(t)
+			b := NewBroker(js)
+			msg.Body = []byte("testing")
+			msg.Topic = "orders.created"
+
+			err := b.Send(context.Background(), msg)
+
+			assert.ErrorIs(t, err, ErrInvalidHeader)
+			assert.True(t, outbox.IsPermanent(err))
+			stream, err := js.Stream(context.Background(), "ORDERS")
+			require.NoError(t, err)
+			info, err := stream.Info(context.Background())
+			require.NoError(t, err)
+			assert.Zero(t, info.State.Msgs)
+		})
+	}
+}
+
+func TestBroker_Send_cancelledContext(t *testing.T) {
+	js := newJetStream(t)
+	b := NewBroker(js)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := b.Send(ctx, outbox.Message{Body: []byte("testing"), Topic: "orders.created"})
+
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestBroker_Conformance(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) brokertest.Harness {
+		js := newJetStream(t)
+		b := NewBroker(js, WithSubject(func(topic string) string {
+			return "orders." + topic
+		}))
+		return brokertest.Harness{
+			Broker: b,
+			Delivered: func(t *testing.T) []outbox.Message {
+				stream, err := js.Stream(context.Background(), "ORDERS")
+				require.NoError(t, err)
+				info, err := stream.Info(context.Background())
+				require.NoError(t, err)
+				var messages []outbox.Message
+				for seq := info.State.FirstSeq; seq <= info.State.LastSeq && info.State.Msgs > 0; seq++ {
+					msg, err := stream.GetMsg(context.Background(), seq)
+					require.NoError(t, err)
+					event := outbox.Message{
+						Key:     msg.Header.Get(KeyHeader),
+						Headers: map[string]string{},
+						Body:    msg.Data,
+						Topic:   strings.TrimPrefix(msg.Subject, "orders."),
+					}
+					for k := range msg.Header {
+						event.Headers[k] = msg.Header.Get(k)
+					}
+					messages = append(messages, event)
+				}
+				return messages
+			},
+			Fail: func(t *testing.T) {
+				require.NoError(t, js.DeleteStream(context.Background(), "ORDERS"))
+			},
+		}
+	})
+}
@@ -0,0 +1,77 @@
+// Package redis provides a Redis Streams message broker implementation
+package redis
+
+import (
+	"context"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/pkritiotis/outbox"
+)
+
+const (
+	// KeyField is the stream entry field with the message key
+	KeyField = "key"
+	// BodyField is the stream entry field with the message body
+	BodyField = "body"
+	// RecordIDField is the stream entry field with the id of the outbox record
+	RecordIDField = "outbox-record-id"
+	// HeaderFieldPrefix is the prefix of the stream entry fields with the message headers.
+	// A header with multiple values is stored in multiple fields with the same name
+	HeaderFieldPrefix = "header:"
+)
+
+// Settings contain the redis broker settings
+type Settings struct {
+	// MaxLen trims every stream to MaxLen entries on every add when greater than zero
+	MaxLen int64
+	// ApproxMaxLen trims the streams with the ~ modifier, which is cheaper but may keep more than MaxLen entries
+	ApproxMaxLen bool
+}
+
+// Broker implements the MessageBroker interface with Redis Streams
+type Broker struct {
+	client   redis.Cmdable
+	settings Settings
+}
+
+// NewBroker constructor
+func NewBroker(client redis.Cmdable, settings Settings) *Broker {
+	return &Broker{client: client, settings: settings}
+}
+
+// Send adds the message to the stream named after its topic
+func (b *Broker) Send(ctx context.Context, event outbox.Message) error {
+	return b.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: event.Topic,
+		MaxLen: b.settings.MaxLen,
+		Approx: b.settings.ApproxMaxLen,
+		Values: entryValues(ctx, event),
+	}).Err()
+}
+
+// entryValues returns the field value pairs of the stream entry of the message
+func entryValues(ctx context.Context, event outbox.Message) []interface{} {
+	key := []byte(event.Key)
+	if event.BinaryKey != nil {
+		key = event.BinaryKey
+	}
+	values := []interface{}{KeyField, key, BodyField, event.Body}
+	if id, ok := outbox.RecordIDFromContext(ctx); ok {
+		values = append(values, RecordIDField, id.String())
+	}
+
+	keys := make([]string, 0, len(event.Headers))
+	for k := range event.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		values = append(values, HeaderFieldPrefix+k, event.Headers[k])
+	}
+	for _, h := range event.BinaryHeaders {
+		values = append(values, HeaderFieldPrefix+h.Key, h.Value)
+	}
+	return values
+}
@@ -0,0 +1,158 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox"
+	"github.com/pkritiotis/outbox/broker/brokertest"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// newClient returns a client of an in-process miniredis server
+func newClient(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	srv := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return srv, client
+}
+
+func TestBroker_Send(t *testing.T) {
+	recordID := uuid.New()
+	tests := map[string]struct {
+		ctx       context.Context
+		event     outbox.Message
+		expFields []string
+	}{
+		"Message should be added with its key, body and headers": {
+			ctx: context.Background(),
+			event: outbox.Message{
+				Key:     "sampleKey",
+				Headers: map[string]string{"b": "2", "a": "1"},
+				BinaryHeaders: []outbox.Header{
+					{Key: "trace", Value: []byte("x")},
+					{Key: "trace", Value: []byte("y")},
+				},
+				Body:  []byte("testing"),
+				Topic: "sampleTopic",
+			},
+			expFields: []string{
+				KeyField, "sampleKey",
+				BodyField, "testing",
+				HeaderFieldPrefix + "a", "1",
+				HeaderFieldPrefix + "b", "2",
+				HeaderFieldPrefix + "trace", "x",
+				HeaderFieldPrefix + "trace", "y",
+			},
+		},
+		"Binary key and record id should be added": {
+			ctx: outbox.ContextWithRecordID(context.Background(), recordID),
+			event: outbox.Message{
+				Key:       "sampleKey",
+				BinaryKey: []byte("binaryKey"),
+				Body:      []byte("testing"),
+				Topic:     "sampleTopic",
+			},
+			expFields: []string{
+				KeyField, "binaryKey",
+				BodyField, "testing",
+				RecordIDField, recordID.String(),
+			},
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			srv, client := newClient(t)
+			b := NewBroker(client, Settings{})
+
+			err := b.Send(tt.ctx, tt.event)
+
+			assert.Nil(t, err)
+			entries, err := srv.Stream(tt.event.Topic)
+			assert.Nil(t, err)
+			assert.Len(t, entries, 1)
+			assert.Equal(t, tt.expFields, entries[0].Values)
+		})
+	}
+}
+
+func TestBroker_Send_maxLen(t *testing.T) {
+	srv, client := newClient(t)
+	b := NewBroker(client, Settings{MaxLen: 2})
+
+	for i := 0; i < 5; i++ {
+		err := b.Send(context.Background(), outbox.Message{Body: []byte(strconv.Itoa(i)), Topic: "sampleTopic"})
+		assert.Nil(t, err)
+	}
+
+	entries, err := srv.Stream("sampleTopic")
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "3", entries[0].Values[3])
+	assert.Equal(t, "4", entries[1].Values[3])
+}
+
+func TestBroker_Send_error(t *testing.T) {
+	srv, client := newClient(t)
+	srv.SetError("READONLY You can't write against a read only replica.")
+	b := NewBroker(client, Settings{})
+
+	err := b.Send(context.Background(), outbox.Message{Body: []byte("testing"), Topic: "sampleTopic"})
+
+	assert.EqualError(t, err, "READONLY You can't write against a read only replica.")
+}
+
+func TestBroker_Send_cancelledContext(t *testing.T) {
+	_, client := newClient(t)
+	b := NewBroker(client, Settings{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := b.Send(ctx, outbox.Message{Body: []byte("testing"), Topic: "sampleTopic"})
+
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestBroker_Conformance(t *testing.T) {
+	brokertest.RunConformance(t, func(t *testing.T) brokertest.Harness {
+		srv, client := newClient(t)
+		return brokertest.Harness{
+			Broker: NewBroker(client, Settings{}),
+			Delivered: func(t *testing.T) []outbox.Message {
+				if !srv.Exists(brokertest.Topic) {
+					return nil
+				}
+				entries, err := srv.Stream(brokertest.Topic)
+				assert.Nil(t, err)
+				var messages []outbox.Message
+				for _, entry := range entries {
+					event := outbox.Message{Topic: brokertest.Topic, Headers: map[string]string{}}
+					for i := 0; i+1 < len(entry.Values); i += 2 {
+						field, value := entry.Values[i], entry.Values[i+1]
+						switch {
+						case field == KeyField:
+							event.Key = value
+						case field == BodyField:
+							event.Body = []byte(value)
+						case strings.HasPrefix(field, HeaderFieldPrefix):
+							event.Headers[strings.TrimPrefix(field, HeaderFieldPrefix)] = value
+						}
+					}
+					messages = append(messages, event)
+				}
+				return messages
+			},
+			Fail: func(t *testing.T) {
+				srv.SetError("ERR failed")
+			},
+		}
+	})
+}
@@ -1,6 +1,10 @@
 package outbox
 
-import "github.com/stretchr/testify/mock"
+import (
+	"context"
+
+	"github.com/stretchr/testify/mock"
+)
 
 // MockBroker mocks the Broker interface
 type MockBroker struct {
@@ -8,7 +12,7 @@ type MockBroker struct {
 }
 
 // Send method mock
-func (m *MockBroker) Send(message Message) error {
-	args := m.Called(message)
+func (m *MockBroker) Send(ctx context.Context, message Message) error {
+	args := m.Called(ctx, message)
 	return args.Error(0)
 }
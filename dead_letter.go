@@ -0,0 +1,70 @@
+package outbox
+
+import (
+	"context"
+	"strconv"
+)
+
+const (
+	// DeadLetterRecordIDHeader is the dead-letter message header with the outbox record id
+	DeadLetterRecordIDHeader = "x-outbox-record-id"
+	// DeadLetterTopicHeader is the dead-letter message header with the original topic
+	DeadLetterTopicHeader = "x-outbox-original-topic"
+	// DeadLetterErrorHeader is the dead-letter message header with the last delivery error
+	DeadLetterErrorHeader = "x-outbox-error"
+	// DeadLetterAttemptsHeader is the dead-letter message header with the number of delivery attempts
+	DeadLetterAttemptsHeader = "x-outbox-attempts"
+)
+
+// DeadLetterPolicy defines where the messages of records that reached MaxAttemptsReached are sent.
+// Dead lettering is enabled when Broker or Topic is set. Records that were sent successfully move to DeadLettered,
+// otherwise they move to PendingDeadLetter and the dispatcher sends them again on its next processing runs,
+// after the RetrialPolicy.Backoff delay
+type DeadLetterPolicy struct {
+	// Broker receives the dead-letter messages. The dispatcher MessageBroker is used when nil
+	Broker MessageBroker
+	// Topic maps the original topic to the dead-letter topic. The original topic is kept when nil
+	Topic func(topic string) string
+	// OnDeadLetter is an optional callback that is called for every dead-lettered record.
+	// err is set when the message could not be sent to the dead-letter broker
+	OnDeadLetter func(rec Record, err error)
+}
+
+// DeadLetterTopicSuffix returns a DeadLetterPolicy.Topic function that appends suffix to the original topic
+func DeadLetterTopicSuffix(suffix string) func(topic string) string {
+	return func(topic string) string {
+		return topic + suffix
+	}
+}
+
+func (p DeadLetterPolicy) enabled() bool {
+	return p.Broker != nil || p.Topic != nil
+}
+
+// send delivers the dead-letter message of rec to the dead-letter broker, or fallback when none is configured
+func (p DeadLetterPolicy) send(ctx context.Context, fallback MessageBroker, rec Record) error {
+	broker := p.Broker
+	if broker == nil {
+		broker = fallback
+	}
+	return broker.Send(ctx, p.message(rec))
+}
+
+// message returns the dead-letter message of rec with the failure details in its headers
+func (p DeadLetterPolicy) message(rec Record) Message {
+	msg := rec.Message
+	msg.Headers = make(map[string]string, len(rec.Message.Headers)+4)
+	for k, v := range rec.Message.Headers {
+		msg.Headers[k] = v
+	}
+	msg.Headers[DeadLetterRecordIDHeader] = rec.ID.String()
+	msg.Headers[DeadLetterTopicHeader] = rec.Message.Topic
+	msg.Headers[DeadLetterAttemptsHeader] = strconv.Itoa(rec.NumberOfAttempts)
+	if rec.Error != nil {
+		msg.Headers[DeadLetterErrorHeader] = *rec.Error
+	}
+	if p.Topic != nil {
+		msg.Topic = p.Topic(rec.Message.Topic)
+	}
+	return msg
+}
@@ -0,0 +1,169 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestDeadLetterPolicy_message(t *testing.T) {
+	errMsg := "broker error"
+	rec := Record{
+		ID: uuid.New(),
+		Message: Message{
+			Key:     "testKey",
+			Headers: map[string]string{"testHeader": "testValue"},
+			Body:    []byte("testBody"),
+			Topic:   "testTopic",
+		},
+		NumberOfAttempts: 3,
+		Error:            &errMsg,
+	}
+	policy := DeadLetterPolicy{Topic: DeadLetterTopicSuffix(".dlq")}
+
+	msg := policy.message(rec)
+
+	assert.Equal(t, Message{
+		Key: "testKey",
+		Headers: map[string]string{
+			"testHeader":             "testValue",
+			DeadLetterRecordIDHeader: rec.ID.String(),
+			DeadLetterTopicHeader:    "testTopic",
+			DeadLetterErrorHeader:    "broker error",
+			DeadLetterAttemptsHeader: "3",
+		},
+		Body:  []byte("testBody"),
+		Topic: "testTopic.dlq",
+	}, msg)
+	assert.Equal(t, map[string]string{"testHeader": "testValue"}, rec.Message.Headers)
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_deadLetter(t *testing.T) {
+	sendErr := errors.New("message broker error")
+	tests := map[string]struct {
+		deadLetterErr error
+		expState      RecordState
+	}{
+		"Successful dead lettering should move the record to DeadLettered": {
+			expState: DeadLettered,
+		},
+		"Failed dead lettering should move the record to PendingDeadLetter": {
+			deadLetterErr: errors.New("dead-letter broker error"),
+			expState:      PendingDeadLetter,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			rec := Record{ID: uuid.New(), Message: Message{Topic: "testTopic"}, State: PendingDelivery, NumberOfAttempts: 1}
+			store := &stubStore{records: []Record{rec}}
+			broker := &MockBroker{}
+			broker.On("Send", mock.Anything, rec.Message).Return(sendErr)
+			deadLetterBroker := &MockBroker{}
+			deadLetterBroker.On("Send", mock.Anything, mock.MatchedBy(func(msg Message) bool {
+				return msg.Topic == "testTopic" &&
+					msg.Headers[DeadLetterErrorHeader] == sendErr.Error() &&
+					msg.Headers[DeadLetterAttemptsHeader] == "2"
+			})).Return(tt.deadLetterErr)
+			var hookRecord Record
+			var hookErr error
+			d := newProcessor(store, broker, "1", DispatcherSettings{
+				RetrialPolicy: RetrialPolicy{MaxSendAttemptsEnabled: true, MaxSendAttempts: 2},
+				DeadLetterPolicy: DeadLetterPolicy{
+					Broker: deadLetterBroker,
+					OnDeadLetter: func(rec Record, err error) {
+						hookRecord = rec
+						hookErr = err
+					},
+				},
+			})
+
+			err := d.ProcessRecords(context.Background())
+
+			assert.ErrorIs(t, err, sendErr)
+			assert.Equal(t, tt.deadLetterErr != nil, errors.Is(err, tt.deadLetterErr))
+			deadLetterBroker.AssertExpectations(t)
+			assert.Equal(t, tt.expState, store.updated[0].State)
+			assert.Equal(t, tt.expState, hookRecord.State)
+			assert.Equal(t, tt.deadLetterErr, hookErr)
+		})
+	}
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_deadLetterRetry(t *testing.T) {
+	deadLetterErr := errors.New("dead-letter broker error")
+	tests := map[string]struct {
+		deadLetterErr error
+		expState      RecordState
+	}{
+		"Successful retry should move the record to DeadLettered": {
+			expState: DeadLettered,
+		},
+		"Failed retry should keep the record in PendingDeadLetter until the next attempt": {
+			deadLetterErr: deadLetterErr,
+			expState:      PendingDeadLetter,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			lockID := "1"
+			rec := Record{ID: uuid.New(), Message: Message{Topic: "testTopic"}, State: PendingDeadLetter, NumberOfAttempts: 2, LockID: &lockID}
+			store := &stubStore{records: []Record{rec}}
+			broker := &MockBroker{}
+			deadLetterBroker := &MockBroker{}
+			deadLetterBroker.On("Send", mock.Anything, mock.MatchedBy(func(msg Message) bool {
+				return msg.Headers[DeadLetterRecordIDHeader] == rec.ID.String()
+			})).Return(tt.deadLetterErr)
+			var hookErr error
+			d := newProcessor(store, broker, "1", DispatcherSettings{
+				RetrialPolicy: RetrialPolicy{MaxSendAttemptsEnabled: true, MaxSendAttempts: 2, Backoff: ConstantBackoff{Delay: time.Minute}},
+				DeadLetterPolicy: DeadLetterPolicy{
+					Broker: deadLetterBroker,
+					OnDeadLetter: func(_ Record, err error) {
+						hookErr = err
+					},
+				},
+			})
+
+			err := d.ProcessRecords(context.Background())
+
+			assert.Equal(t, tt.deadLetterErr != nil, errors.Is(err, deadLetterErr))
+			broker.AssertNotCalled(t, "Send", mock.Anything, mock.Anything)
+			deadLetterBroker.AssertExpectations(t)
+			assert.Len(t, store.updated, 1)
+			assert.Equal(t, tt.expState, store.updated[0].State)
+			assert.Equal(t, 2, store.updated[0].NumberOfAttempts)
+			assert.Nil(t, store.updated[0].LockID)
+			assert.Equal(t, tt.deadLetterErr != nil, store.updated[0].NextAttemptOn != nil)
+			assert.Equal(t, tt.deadLetterErr != nil, store.updated[0].ProcessedOn == nil)
+			assert.Equal(t, tt.deadLetterErr, hookErr)
+		})
+	}
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_deadLetterTopicOnSameBroker(t *testing.T) {
+	rec := Record{ID: uuid.New(), Message: Message{Topic: "testTopic"}, State: PendingDelivery}
+	store := &stubStore{records: []Record{rec}}
+	broker := &MockBroker{}
+	broker.On("Send", mock.Anything, rec.Message).Return(errors.New("message broker error"))
+	broker.On("Send", mock.Anything, mock.MatchedBy(func(msg Message) bool {
+		return msg.Topic == "testTopic.dlq"
+	})).Return(nil)
+	d := newProcessor(store, broker, "1", DispatcherSettings{
+		RetrialPolicy:    RetrialPolicy{MaxSendAttemptsEnabled: true, MaxSendAttempts: 1},
+		DeadLetterPolicy: DeadLetterPolicy{Topic: DeadLetterTopicSuffix(".dlq")},
+	})
+
+	err := d.ProcessRecords(context.Background())
+
+	assert.EqualError(t, errors.Unwrap(err.(*BatchError).Failures[0]), fmt.Sprintf("An error occurred when trying to send the message to the broker: %v", "message broker error"))
+	broker.AssertNumberOfCalls(t, "Send", 2)
+	assert.Equal(t, DeadLettered, store.updated[0].State)
+}
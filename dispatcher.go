@@ -1,28 +1,48 @@
 package outbox
 
 import (
+	"context"
 	"log"
+	"sync"
 	"time"
 )
 
+// errorsBufferSize is the capacity of the RunHandle errors channel
+const errorsBufferSize = 10
+
 type processor interface {
-	ProcessRecords() error
+	ProcessRecords(ctx context.Context) error
 }
 
 type unlocker interface {
-	UnlockExpiredMessages() error
+	UnlockExpiredMessages(ctx context.Context) error
 }
 
 type cleaner interface {
-	RemoveExpiredMessages() error
+	RemoveExpiredMessages(ctx context.Context) error
 }
 
 // RetrialPolicy contains the retrial settings
 type RetrialPolicy struct {
 	MaxSendAttemptsEnabled bool
 	MaxSendAttempts        int
+	// Backoff delays the next attempt of a failed record. Records are not claimed before their Record.NextAttemptOn.
+	// When nil a failed record is retried on the next processing run
+	Backoff BackoffPolicy
 }
 
+// DeliveryOrdering defines the ordering guarantee of the delivered messages
+type DeliveryOrdering int
+
+const (
+	// UnorderedDelivery delivers the records without any ordering guarantee
+	UnorderedDelivery DeliveryOrdering = iota
+	// KeyOrderedDelivery delivers records with the same Message.Key in CreatedOn order, across processing runs and
+	// dispatcher replicas. A record that fails blocks only the later records of its own key.
+	// Records with an empty Message.Key are delivered without ordering guarantees
+	KeyOrderedDelivery
+)
+
 // DispatcherSettings defines the set of configurations for the dispatcher
 type DispatcherSettings struct {
 	ProcessInterval           time.Duration
@@ -31,6 +51,21 @@ type DispatcherSettings struct {
 	CleanupWorkerInterval     time.Duration
 	RetrialPolicy             RetrialPolicy
 	MessagesRetentionDuration time.Duration
+	// DeadLetterPolicy defines where the messages of the records that reached the max attempts are sent
+	DeadLetterPolicy DeadLetterPolicy
+	// MaxBatchSize is the maximum number of records claimed by a single processing run. Defaults to 100
+	MaxBatchSize int
+	// SendWorkers is the number of workers delivering the claimed records concurrently. Defaults to 1.
+	// It does not apply to a BatchMessageBroker, whose batches are sent one at a time
+	SendWorkers int
+	// Ordering is the delivery ordering guarantee. Defaults to UnorderedDelivery
+	Ordering DeliveryOrdering
+	// OnProcessed is an optional callback that receives the number of delivered, failed and skipped records
+	// of every processing run that claimed records
+	OnProcessed func(result ProcessResult)
+	// ShutdownTimeout bounds how long a dispatcher started with Start waits for in-flight work on shutdown
+	// before cancelling it. Zero waits until the in-flight work completes
+	ShutdownTimeout time.Duration
 }
 
 // Dispatcher initializes and runs the outbox dispatcher
@@ -48,7 +83,7 @@ func NewDispatcher(store Store, broker MessageBroker, settings DispatcherSetting
 			store,
 			broker,
 			machineID,
-			settings.RetrialPolicy,
+			settings,
 		),
 		recordUnlocker: newRecordUnlocker(
 			store,
@@ -63,84 +98,139 @@ func NewDispatcher(store Store, broker MessageBroker, settings DispatcherSetting
 }
 
 // Run periodically checks for new outbox messages from the Store, sends the messages through the MessageBroker
-// and updates the message status accordingly
+// and updates the message status accordingly. Sending to doneChan stops the workers and cancels their in-flight work
 func (d Dispatcher) Run(errChan chan<- error, doneChan <-chan struct{}) {
-	doneProc := make(chan struct{}, 1)
-	doneUnlock := make(chan struct{}, 1)
-	doneClear := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
 
 	go func() {
 		<-doneChan
-		doneProc <- struct{}{}
-		doneUnlock <- struct{}{}
-		doneClear <- struct{}{}
+		cancel()
 	}()
 
-	go d.runRecordProcessor(errChan, doneProc)
-	go d.runRecordUnlocker(errChan, doneUnlock)
-	go d.runRecordCleaner(errChan, doneClear)
+	report := func(err error) {
+		reportError(ctx, errChan, err)
+	}
+	go d.runRecordProcessor(ctx, ctx, report)
+	go d.runRecordUnlocker(ctx, ctx, report)
+	go d.runRecordCleaner(ctx, ctx, report)
 }
 
-// runRecordProcessor processes the unsent records of the store
-func (d Dispatcher) runRecordProcessor(errChan chan<- error, doneChan <-chan struct{}) {
-	ticker := time.NewTicker(d.settings.ProcessInterval)
-	for {
-		log.Print("Record processor Running")
-		err := d.recordProcessor.ProcessRecords()
-		if err != nil {
-			errChan <- err
-		}
-		log.Print("Record Processing Finished")
+// RunHandle controls a Dispatcher started with Start
+type RunHandle struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	errs   chan error
+}
+
+// Errors returns the errors reported by the dispatcher workers. The channel is buffered and is closed once the
+// dispatcher has stopped. Errors that do not fit in the buffer are logged and dropped so that the workers never block
+func (h *RunHandle) Errors() <-chan error {
+	return h.errs
+}
 
+// Wait blocks until all dispatcher workers have stopped
+func (h *RunHandle) Wait() {
+	<-h.done
+}
+
+// Stop signals the dispatcher workers to stop and waits until they have finished their in-flight work
+func (h *RunHandle) Stop() {
+	h.cancel()
+	h.Wait()
+}
+
+// Start runs the dispatcher workers in the background until ctx is done or RunHandle.Stop is called.
+// On shutdown every worker completes its in-flight run, so the records of the current batch are delivered and
+// their locks released, before RunHandle.Wait returns. DispatcherSettings.ShutdownTimeout bounds that drain period
+func (d Dispatcher) Start(ctx context.Context) *RunHandle {
+	stopCtx, cancel := context.WithCancel(ctx)
+	workCtx, cancelWork := context.WithCancel(context.WithoutCancel(ctx))
+	h := &RunHandle{
+		cancel: cancel,
+		done:   make(chan struct{}),
+		errs:   make(chan error, errorsBufferSize),
+	}
+	report := func(err error) {
 		select {
-		case <-ticker.C:
-			continue
-		case <-doneChan:
-			ticker.Stop()
-			log.Print("Stopping Record processor")
-			return
+		case h.errs <- err:
+		default:
+			log.Printf("Dropping dispatcher error: %v", err)
 		}
 	}
-}
 
-func (d Dispatcher) runRecordUnlocker(errChan chan<- error, doneChan <-chan struct{}) {
-	ticker := time.NewTicker(d.settings.LockCheckerInterval)
-	for {
-		log.Print("Record unlocker Running")
-		err := d.recordUnlocker.UnlockExpiredMessages()
-		if err != nil {
-			errChan <- err
-		}
-		log.Print("Record unlocker Finished")
-		select {
-		case <-ticker.C:
-			continue
-		case <-doneChan:
-			ticker.Stop()
-			log.Print("Stopping Record unlocker")
-			return
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		d.runRecordProcessor(stopCtx, workCtx, report)
+	}()
+	go func() {
+		defer wg.Done()
+		d.runRecordUnlocker(stopCtx, workCtx, report)
+	}()
+	go func() {
+		defer wg.Done()
+		d.runRecordCleaner(stopCtx, workCtx, report)
+	}()
 
+	go func() {
+		<-stopCtx.Done()
+		if d.settings.ShutdownTimeout > 0 {
+			timer := time.AfterFunc(d.settings.ShutdownTimeout, cancelWork)
+			defer timer.Stop()
 		}
-	}
+		wg.Wait()
+		cancelWork()
+		close(h.errs)
+		close(h.done)
+	}()
+
+	return h
 }
 
-func (d Dispatcher) runRecordCleaner(errChan chan<- error, doneChan <-chan struct{}) {
-	ticker := time.NewTicker(d.settings.CleanupWorkerInterval)
+// runRecordProcessor processes the unsent records of the store
+func (d Dispatcher) runRecordProcessor(stopCtx context.Context, workCtx context.Context, report func(error)) {
+	runWorker(stopCtx, workCtx, "Record processor", d.settings.ProcessInterval, d.recordProcessor.ProcessRecords, report)
+}
+
+func (d Dispatcher) runRecordUnlocker(stopCtx context.Context, workCtx context.Context, report func(error)) {
+	runWorker(stopCtx, workCtx, "Record unlocker", d.settings.LockCheckerInterval, d.recordUnlocker.UnlockExpiredMessages, report)
+}
+
+func (d Dispatcher) runRecordCleaner(stopCtx context.Context, workCtx context.Context, report func(error)) {
+	runWorker(stopCtx, workCtx, "Record retention cleaner", d.settings.CleanupWorkerInterval, d.recordCleaner.RemoveExpiredMessages, report)
+}
+
+// runWorker executes work every interval until stopCtx is done.
+// work is executed with workCtx, so an in-flight execution is only cancelled when workCtx is
+func runWorker(stopCtx context.Context, workCtx context.Context, name string, interval time.Duration, work func(ctx context.Context) error, report func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
-		log.Print("Record retention cleaner Running")
-		err := d.recordCleaner.RemoveExpiredMessages()
+		log.Printf("%v Running", name)
+		err := work(workCtx)
 		if err != nil {
-			errChan <- err
+			report(err)
 		}
-		log.Print("Record retention cleaner Finished")
+		log.Printf("%v Finished", name)
+
 		select {
 		case <-ticker.C:
-			continue
-		case <-doneChan:
-			ticker.Stop()
-			log.Print("Stopping Record retention cleaner")
-			return
-
+			// Prefer stopping when the stop signal and the next tick arrive together
+			if stopCtx.Err() == nil {
+				continue
+			}
+		case <-stopCtx.Done():
 		}
+		log.Printf("Stopping %v", name)
+		return
+	}
+}
+
+// reportError sends err to errChan unless the dispatcher is stopped in the meantime
+func reportError(ctx context.Context, errChan chan<- error, err error) {
+	select {
+	case errChan <- err:
+	case <-ctx.Done():
 	}
 }
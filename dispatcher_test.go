@@ -1,11 +1,13 @@
 package outbox
 
 import (
+	"context"
 	"errors"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func TestDispatcher_Run(t *testing.T) {
@@ -21,17 +23,17 @@ func TestDispatcher_Run(t *testing.T) {
 		"Should execute processor, unlocker, and cleaner successfully": {
 			recordProcessor: func() *mockRecordProcessor {
 				mp := mockRecordProcessor{}
-				mp.On("ProcessRecords").Return(nil)
+				mp.On("ProcessRecords", mock.Anything).Return(nil)
 				return &mp
 			}(),
 			recordUnlocker: func() *mockRecordUnlocker {
 				mp := mockRecordUnlocker{}
-				mp.On("UnlockExpiredMessages").Return(nil)
+				mp.On("UnlockExpiredMessages", mock.Anything).Return(nil)
 				return &mp
 			}(),
 			recordCleaner: func() *mockRecordCleaner {
 				mp := mockRecordCleaner{}
-				mp.On("RemoveExpiredMessages").Return(nil)
+				mp.On("RemoveExpiredMessages", mock.Anything).Return(nil)
 				return &mp
 			}(),
 			settings: DispatcherSettings{
@@ -52,17 +54,17 @@ func TestDispatcher_Run(t *testing.T) {
 		"Error in process records should return error": {
 			recordProcessor: func() *mockRecordProcessor {
 				mp := mockRecordProcessor{}
-				mp.On("ProcessRecords").Return(errors.New("process error"))
+				mp.On("ProcessRecords", mock.Anything).Return(errors.New("process error"))
 				return &mp
 			}(),
 			recordUnlocker: func() *mockRecordUnlocker {
 				mp := mockRecordUnlocker{}
-				mp.On("UnlockExpiredMessages").Return(nil)
+				mp.On("UnlockExpiredMessages", mock.Anything).Return(nil)
 				return &mp
 			}(),
 			recordCleaner: func() *mockRecordCleaner {
 				mp := mockRecordCleaner{}
-				mp.On("RemoveExpiredMessages").Return(nil)
+				mp.On("RemoveExpiredMessages", mock.Anything).Return(nil)
 				return &mp
 			}(),
 			settings: DispatcherSettings{
@@ -83,17 +85,17 @@ func TestDispatcher_Run(t *testing.T) {
 		"Error in unlock records should return error": {
 			recordProcessor: func() *mockRecordProcessor {
 				mp := mockRecordProcessor{}
-				mp.On("ProcessRecords").Return(nil)
+				mp.On("ProcessRecords", mock.Anything).Return(nil)
 				return &mp
 			}(),
 			recordUnlocker: func() *mockRecordUnlocker {
 				mp := mockRecordUnlocker{}
-				mp.On("UnlockExpiredMessages").Return(errors.New("unlocker error"))
+				mp.On("UnlockExpiredMessages", mock.Anything).Return(errors.New("unlocker error"))
 				return &mp
 			}(),
 			recordCleaner: func() *mockRecordCleaner {
 				mp := mockRecordCleaner{}
-				mp.On("RemoveExpiredMessages").Return(nil)
+				mp.On("RemoveExpiredMessages", mock.Anything).Return(nil)
 				return &mp
 			}(),
 			settings: DispatcherSettings{
@@ -114,17 +116,17 @@ func TestDispatcher_Run(t *testing.T) {
 		"Error in clean records should return error": {
 			recordProcessor: func() *mockRecordProcessor {
 				mp := mockRecordProcessor{}
-				mp.On("ProcessRecords").Return(nil)
+				mp.On("ProcessRecords", mock.Anything).Return(nil)
 				return &mp
 			}(),
 			recordUnlocker: func() *mockRecordUnlocker {
 				mp := mockRecordUnlocker{}
-				mp.On("UnlockExpiredMessages").Return(nil)
+				mp.On("UnlockExpiredMessages", mock.Anything).Return(nil)
 				return &mp
 			}(),
 			recordCleaner: func() *mockRecordCleaner {
 				mp := mockRecordCleaner{}
-				mp.On("RemoveExpiredMessages").Return(errors.New("cleaner error"))
+				mp.On("RemoveExpiredMessages", mock.Anything).Return(errors.New("cleaner error"))
 				return &mp
 			}(),
 			settings: DispatcherSettings{
@@ -175,7 +177,7 @@ func TestNewDispatcher(t *testing.T) {
 			&store,
 			&broker,
 			machineID,
-			RetrialPolicy{},
+			settings,
 		),
 		recordUnlocker: newRecordUnlocker(
 			&store,
@@ -192,3 +194,145 @@ func TestNewDispatcher(t *testing.T) {
 
 	assert.Equal(t, expectedDispatcher, d)
 }
+
+func TestDispatcher_Run_cancelsInFlightWork(t *testing.T) {
+	cancelled := make(chan struct{})
+	mp := &mockRecordProcessor{}
+	mp.On("ProcessRecords", mock.Anything).Run(func(args mock.Arguments) {
+		ctx := args.Get(0).(context.Context)
+		<-ctx.Done()
+		close(cancelled)
+	}).Return(context.Canceled).Once()
+	mu := &mockRecordUnlocker{}
+	mu.On("UnlockExpiredMessages", mock.Anything).Return(nil)
+	mc := &mockRecordCleaner{}
+	mc.On("RemoveExpiredMessages", mock.Anything).Return(nil)
+	d := Dispatcher{
+		recordProcessor: mp,
+		recordUnlocker:  mu,
+		recordCleaner:   mc,
+		settings: DispatcherSettings{
+			ProcessInterval:       time.Minute,
+			LockCheckerInterval:   time.Minute,
+			CleanupWorkerInterval: time.Minute,
+		},
+	}
+	doneChan := make(chan struct{})
+
+	d.Run(make(chan error), doneChan)
+	doneChan <- struct{}{}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("in-flight processing was not cancelled")
+	}
+}
+
+func TestDispatcher_Start_drainsInFlightWorkOnStop(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var workErr error
+	mp := &mockRecordProcessor{}
+	mp.On("ProcessRecords", mock.Anything).Run(func(args mock.Arguments) {
+		close(started)
+		<-release
+		workErr = args.Get(0).(context.Context).Err()
+	}).Return(nil).Once()
+	mu := &mockRecordUnlocker{}
+	mu.On("UnlockExpiredMessages", mock.Anything).Return(nil)
+	mc := &mockRecordCleaner{}
+	mc.On("RemoveExpiredMessages", mock.Anything).Return(nil)
+	d := Dispatcher{
+		recordProcessor: mp,
+		recordUnlocker:  mu,
+		recordCleaner:   mc,
+		settings: DispatcherSettings{
+			ProcessInterval:       time.Minute,
+			LockCheckerInterval:   time.Minute,
+			CleanupWorkerInterval: time.Minute,
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	h := d.Start(ctx)
+	<-started
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		h.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("dispatcher stopped before the in-flight work completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-stopped
+
+	assert.Nil(t, workErr)
+	mp.AssertNumberOfCalls(t, "ProcessRecords", 1)
+	_, open := <-h.Errors()
+	assert.False(t, open)
+}
+
+func TestDispatcher_Start_cancelsInFlightWorkAfterShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	mp := &mockRecordProcessor{}
+	mp.On("ProcessRecords", mock.Anything).Run(func(args mock.Arguments) {
+		close(started)
+		<-args.Get(0).(context.Context).Done()
+	}).Return(context.Canceled).Once()
+	mu := &mockRecordUnlocker{}
+	mu.On("UnlockExpiredMessages", mock.Anything).Return(nil)
+	mc := &mockRecordCleaner{}
+	mc.On("RemoveExpiredMessages", mock.Anything).Return(nil)
+	d := Dispatcher{
+		recordProcessor: mp,
+		recordUnlocker:  mu,
+		recordCleaner:   mc,
+		settings: DispatcherSettings{
+			ProcessInterval:       time.Minute,
+			LockCheckerInterval:   time.Minute,
+			CleanupWorkerInterval: time.Minute,
+			ShutdownTimeout:       10 * time.Millisecond,
+		},
+	}
+
+	h := d.Start(context.Background())
+	<-started
+	h.Stop()
+
+	assert.Equal(t, context.Canceled, <-h.Errors())
+}
+
+func TestDispatcher_Start_doesNotBlockOnUnreadErrors(t *testing.T) {
+	mp := &mockRecordProcessor{}
+	mp.On("ProcessRecords", mock.Anything).Return(errors.New("process error"))
+	mu := &mockRecordUnlocker{}
+	mu.On("UnlockExpiredMessages", mock.Anything).Return(errors.New("unlocker error"))
+	mc := &mockRecordCleaner{}
+	mc.On("RemoveExpiredMessages", mock.Anything).Return(errors.New("cleaner error"))
+	d := Dispatcher{
+		recordProcessor: mp,
+		recordUnlocker:  mu,
+		recordCleaner:   mc,
+		settings: DispatcherSettings{
+			ProcessInterval:       time.Millisecond,
+			LockCheckerInterval:   time.Millisecond,
+			CleanupWorkerInterval: time.Millisecond,
+		},
+	}
+
+	h := d.Start(context.Background())
+	time.Sleep(50 * time.Millisecond)
+	h.Stop()
+
+	var errs []error
+	for err := range h.Errors() {
+		errs = append(errs, err)
+	}
+	assert.Len(t, errs, errorsBufferSize)
+}
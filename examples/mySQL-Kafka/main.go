@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/IBM/sarama"
@@ -19,16 +21,11 @@ type SampleMessage struct {
 }
 
 var (
-	errChan  chan error
-	doneChan chan struct{}
-
 	sqlSettings mysql.Settings
 	brokerAddr  string
 )
 
 func init() {
-	errChan = make(chan error)
-	doneChan = make(chan struct{})
 	sqlSettings = mysql.Settings{
 		MySQLUsername: "root",
 		MySQLPass:     "a123456",
@@ -40,7 +37,8 @@ func init() {
 }
 
 func main() {
-	defer func() { doneChan <- struct{}{} }()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
 	// Initialize the sql store
 	store, err := mysql.NewStore(sqlSettings)
@@ -67,11 +65,12 @@ func main() {
 		MessagesRetentionDuration: 1 * time.Minute,
 	}
 	dispatcher := outbox.NewDispatcher(store, broker, settings, "1")
-	dispatcher.Run(errChan, doneChan)
+	h := dispatcher.Start(ctx)
 
 	go func() {
-		err = <-errChan
-		fmt.Printf(err.Error())
+		for err := range h.Errors() {
+			fmt.Println(err.Error())
+		}
 	}()
 
 	// Initialize the outbox service
@@ -79,10 +78,10 @@ func main() {
 
 	// Open a db connection and perform a transaction
 	db, _ := openDbConnection()
-	tx, _ := db.BeginTx(context.Background(), nil)
+	tx, _ := db.BeginTx(ctx, nil)
 
 	encodedData, _ := json.Marshal(SampleMessage{message: "ok"})
-	publisher.Send(outbox.Message{
+	publisher.SendContext(ctx, outbox.Message{
 		Key:     "sampleKey",
 		Headers: nil,
 		Body:    encodedData,
@@ -93,7 +92,9 @@ func main() {
 		fmt.Printf("Could not commit the sql transaction: %v", err)
 		os.Exit(1)
 	}
-	<-doneChan
+
+	// Wait until the dispatcher has delivered the in-flight batch after SIGTERM
+	h.Wait()
 }
 
 func openDbConnection() (*sql.DB, error) {
@@ -1,12 +1,26 @@
 CREATE TABLE outbox (
         id varchar(100) NOT NULL,
         data BLOB NOT NULL,
+        message_key varchar(255) NOT NULL DEFAULT '',
+        topic varchar(255) NOT NULL DEFAULT '',
         state INT NOT NULL,
-        created_on DATETIME NOT NULL,
+        created_on DATETIME(6) NOT NULL,
         locked_by varchar(100) NULL,
         locked_on DATETIME NULL,
         processed_on DATETIME NULL,
         number_of_attempts INT NOT NULL,
         last_attempted_on DATETIME NULL,
-        error varchar(1000) NULL
+        error varchar(1000) NULL,
+        next_attempt_on DATETIME(6) NULL,
+        requeued_by varchar(100) NULL,
+        requeued_on DATETIME(6) NULL,
+        seq BIGINT NOT NULL AUTO_INCREMENT,
+        PRIMARY KEY (id),
+        UNIQUE INDEX outbox_seq_idx (seq),
+        INDEX outbox_claim_idx (state, locked_by, created_on, seq),
+        INDEX outbox_locked_by_idx (locked_by),
+        INDEX outbox_locked_on_idx (locked_on),
+        INDEX outbox_created_on_idx (created_on),
+        INDEX outbox_message_key_idx (message_key, state, created_on, seq),
+        INDEX outbox_topic_idx (topic, state)
 )
\ No newline at end of file
@@ -0,0 +1,34 @@
+package outbox
+
+import "errors"
+
+// permanentError is a delivery error that must not be retried
+type permanentError struct {
+	err error
+}
+
+// Error returns the underlying error message
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks a delivery error of a MessageBroker as permanent.
+// The record processor does not retry the delivery of the message and moves the record to MaxAttemptsReached,
+// or dead-letters it when the DeadLetterPolicy is enabled, regardless of the RetrialPolicy
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err has been marked as permanent with Permanent
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
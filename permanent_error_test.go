@@ -0,0 +1,77 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestIsPermanent(t *testing.T) {
+	errBroker := errors.New("broker error")
+	tests := map[string]struct {
+		err error
+		exp bool
+	}{
+		"Permanent error should be permanent": {
+			err: Permanent(errBroker),
+			exp: true,
+		},
+		"Wrapped permanent error should be permanent": {
+			err: fmt.Errorf("wrapped: %w", Permanent(errBroker)),
+			exp: true,
+		},
+		"Plain error should not be permanent": {
+			err: errBroker,
+			exp: false,
+		},
+		"Nil error should not be permanent": {
+			err: nil,
+			exp: false,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.exp, IsPermanent(tt.err))
+		})
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	errBroker := errors.New("broker error")
+
+	err := Permanent(errBroker)
+
+	assert.ErrorIs(t, err, errBroker)
+	assert.EqualError(t, err, "broker error")
+	assert.Nil(t, Permanent(nil))
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_permanentError(t *testing.T) {
+	records := []Record{{ID: uuid.New(), Message: Message{Body: []byte("rejected")}, State: PendingDelivery}}
+	broker := &MockBroker{}
+	broker.On("Send", mock.Anything, records[0].Message).Return(Permanent(errors.New("400 Bad Request")))
+	store := &stubStore{records: records}
+	d := newProcessor(store, broker, "1", DispatcherSettings{
+		RetrialPolicy: RetrialPolicy{
+			MaxSendAttemptsEnabled: true,
+			MaxSendAttempts:        5,
+			Backoff:                ConstantBackoff{Delay: 1},
+		},
+	})
+
+	err := d.ProcessRecords(context.Background())
+
+	var batchErr *BatchError
+	assert.ErrorAs(t, err, &batchErr)
+	assert.True(t, IsPermanent(err))
+	assert.Len(t, store.updated, 1)
+	assert.Equal(t, MaxAttemptsReached, store.updated[0].State)
+	assert.Equal(t, 1, store.updated[0].NumberOfAttempts)
+	assert.Nil(t, store.updated[0].NextAttemptOn)
+}
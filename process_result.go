@@ -0,0 +1,62 @@
+package outbox
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// ProcessResult summarizes a processing run of the claimed records
+type ProcessResult struct {
+	// Delivered is the number of records delivered to the message broker
+	Delivered int
+	// Failed is the number of records that could not be delivered or updated
+	Failed int
+	// Skipped is the number of records that were not attempted, because the processing was cancelled
+	// or because an earlier record with the same key failed
+	Skipped int
+}
+
+// RecordError is the error of a record that could not be processed
+type RecordError struct {
+	RecordID uuid.UUID
+	Err      error
+}
+
+// Error returns the record error message
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("record %v: %v", e.RecordID, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError is returned when one or more records of a processing run failed.
+// The individual failures can be inspected with errors.Is and errors.As
+type BatchError struct {
+	ProcessResult
+	Failures []*RecordError
+}
+
+// Error returns the batch error message
+func (e *BatchError) Error() string {
+	msg := fmt.Sprintf("%d records failed, %d delivered, %d skipped", e.Failed, e.Delivered, e.Skipped)
+	if len(e.Failures) > 0 {
+		msg += fmt.Sprintf(": %v", e.Failures[0])
+	}
+	if len(e.Failures) > 1 {
+		msg += fmt.Sprintf(" (and %d more)", len(e.Failures)-1)
+	}
+	return msg
+}
+
+// Unwrap returns the record errors
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f
+	}
+	return errs
+}
@@ -1,6 +1,7 @@
 package outbox
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/pkritiotis/outbox/internal/time"
@@ -21,14 +22,33 @@ func NewPublisher(store Store) Publisher {
 
 // Message encapsulates the contents of the message to be sent
 type Message struct {
-	Key     string
-	Headers map[string]string
-	Body    []byte
-	Topic   string
+	Key string
+	// BinaryKey is sent as the message key instead of Key when set.
+	// Stores and KeyOrderedDelivery still use Key
+	BinaryKey []byte
+	Headers   map[string]string
+	// BinaryHeaders are sent after Headers. A key can appear more than once and values can be binary
+	BinaryHeaders []Header
+	Body          []byte
+	Topic         string
+	// Partition pins the message to a partition of Topic on brokers that support it.
+	// The partitioner of the broker is used when nil
+	Partition *int32
+}
+
+// Header is a message header with a binary value
+type Header struct {
+	Key   string
+	Value []byte
 }
 
 // Send stores the provided Message within the provided sql.Tx
 func (o Publisher) Send(msg Message, tx *sql.Tx) error {
+	return o.SendContext(context.Background(), msg, tx)
+}
+
+// SendContext stores the provided Message within the provided sql.Tx using ctx for the store operation
+func (o Publisher) SendContext(ctx context.Context, msg Message, tx *sql.Tx) error {
 	newID := o.uuid.NewUUID()
 	record := Record{
 		ID:          newID,
@@ -40,5 +60,5 @@ func (o Publisher) Send(msg Message, tx *sql.Tx) error {
 		ProcessedOn: nil,
 	}
 
-	return o.store.AddRecordTx(record, tx)
+	return o.store.AddRecordTx(ctx, record, tx)
 }
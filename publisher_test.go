@@ -10,6 +10,7 @@ import (
 	time2 "github.com/pkritiotis/outbox/internal/time"
 	uuid2 "github.com/pkritiotis/outbox/internal/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func TestNew(t *testing.T) {
@@ -64,7 +65,7 @@ func TestOutbox_Add(t *testing.T) {
 					LastAttemptOn:    nil,
 					Error:            nil,
 				}
-				mp.On("AddRecordTx", or, &sampleTx).Return(nil)
+				mp.On("AddRecordTx", mock.Anything, or, &sampleTx).Return(nil)
 				return &mp
 			}(),
 			tx:     &sampleTx,
@@ -86,7 +87,7 @@ func TestOutbox_Add(t *testing.T) {
 					LastAttemptOn:    nil,
 					Error:            nil,
 				}
-				mp.On("AddRecordTx", or, &sampleTx).Return(errors.New("error"))
+				mp.On("AddRecordTx", mock.Anything, or, &sampleTx).Return(errors.New("error"))
 				return &mp
 			}(),
 			tx:     &sampleTx,
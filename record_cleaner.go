@@ -1,6 +1,7 @@
 package outbox
 
 import (
+	"context"
 	time2 "time"
 
 	"github.com/pkritiotis/outbox/internal/time"
@@ -16,9 +17,9 @@ func newRecordCleaner(store Store, maxRecordLifetime time2.Duration) recordClean
 	return recordCleaner{MaxRecordLifetime: maxRecordLifetime, store: store, time: time.NewTimeProvider()}
 }
 
-func (d recordCleaner) RemoveExpiredMessages() error {
+func (d recordCleaner) RemoveExpiredMessages(ctx context.Context) error {
 	expiryTime := d.time.Now().UTC().Add(-d.MaxRecordLifetime)
-	err := d.store.RemoveRecordsBeforeDatetime(expiryTime)
+	err := d.store.RemoveRecordsBeforeDatetime(ctx, expiryTime)
 	if err != nil {
 		return err
 	}
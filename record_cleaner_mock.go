@@ -1,6 +1,8 @@
 package outbox
 
 import (
+	"context"
+
 	"github.com/stretchr/testify/mock"
 )
 
@@ -8,7 +10,7 @@ type mockRecordCleaner struct {
 	mock.Mock
 }
 
-func (m *mockRecordCleaner) RemoveExpiredMessages() error {
-	args := m.Called()
+func (m *mockRecordCleaner) RemoveExpiredMessages(ctx context.Context) error {
+	args := m.Called(ctx)
 	return args.Error(0)
 }
@@ -1,12 +1,14 @@
 package outbox
 
 import (
+	"context"
 	"errors"
 	"testing"
 	time2 "time"
 
 	"github.com/pkritiotis/outbox/internal/time"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func Test_recordCleaner_removeExpiredMessages(t *testing.T) {
@@ -23,7 +25,7 @@ func Test_recordCleaner_removeExpiredMessages(t *testing.T) {
 		"Successful removing should not return error": {
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("RemoveRecordsBeforeDatetime", sampleTime.Add(-2*time2.Minute)).Return(nil)
+				mp.On("RemoveRecordsBeforeDatetime", mock.Anything, sampleTime.Add(-2*time2.Minute)).Return(nil)
 				return &mp
 			}(),
 			time:               timeProvider,
@@ -33,7 +35,7 @@ func Test_recordCleaner_removeExpiredMessages(t *testing.T) {
 		"Error in removing should return error": {
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("RemoveRecordsBeforeDatetime", sampleTime.Add(-2*time2.Minute)).Return(errors.New("test"))
+				mp.On("RemoveRecordsBeforeDatetime", mock.Anything, sampleTime.Add(-2*time2.Minute)).Return(errors.New("test"))
 				return &mp
 			}(),
 			time:               timeProvider,
@@ -49,7 +51,7 @@ func Test_recordCleaner_removeExpiredMessages(t *testing.T) {
 				time:              tt.time,
 				MaxRecordLifetime: tt.MaxMessageLifetime,
 			}
-			err := d.RemoveExpiredMessages()
+			err := d.RemoveExpiredMessages(context.Background())
 			assert.Equal(t, tt.expErr, err)
 		})
 	}
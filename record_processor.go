@@ -1,11 +1,25 @@
 package outbox
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"sync"
+	time2 "time"
+
+	"github.com/google/uuid"
 
 	"github.com/pkritiotis/outbox/internal/time"
 )
 
+const (
+	// defaultMaxBatchSize is the maximum number of records claimed by a single processing run when not configured
+	defaultMaxBatchSize = 100
+	// defaultSendWorkers is the number of concurrent send workers when not configured
+	defaultSendWorkers = 1
+)
+
 // defaultRecordProcessor checks and dispatches new messages to be sent
 type defaultRecordProcessor struct {
 	messageBroker MessageBroker
@@ -13,27 +27,60 @@ type defaultRecordProcessor struct {
 	time          time.Provider
 	machineID     string
 	retrialPolicy RetrialPolicy
+	batchSize     int
+	workers       int
+	ordering      DeliveryOrdering
+	onProcessed   func(result ProcessResult)
+	deadLetter    DeadLetterPolicy
 }
 
 // newProcessor constructs a new defaultRecordProcessor
-func newProcessor(store Store, messageBroker MessageBroker, machineID string, retrialPolicy RetrialPolicy) *defaultRecordProcessor {
+func newProcessor(store Store, messageBroker MessageBroker, machineID string, settings DispatcherSettings) *defaultRecordProcessor {
+	batchSize := settings.MaxBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultMaxBatchSize
+	}
+	workers := settings.SendWorkers
+	if workers <= 0 {
+		workers = defaultSendWorkers
+	}
 	return &defaultRecordProcessor{
 		messageBroker: messageBroker,
 		store:         store,
 		time:          time.NewTimeProvider(),
 		machineID:     machineID,
-		retrialPolicy: retrialPolicy,
+		retrialPolicy: settings.RetrialPolicy,
+		batchSize:     batchSize,
+		workers:       workers,
+		ordering:      settings.Ordering,
+		onProcessed:   settings.OnProcessed,
+		deadLetter:    settings.DeadLetterPolicy,
 	}
 }
 
-// ProcessRecords locks unprocessed messages, tries to deliver them and then unlocks them
-func (d defaultRecordProcessor) ProcessRecords() error {
-	err := d.lockUnprocessedEntities()
-	defer d.store.ClearLocksByLockID(d.machineID)
+// ProcessRecords locks unprocessed messages, tries to deliver them and then unlocks them.
+// With dead lettering enabled the records whose dead-letter message could not be sent are retried first
+func (d defaultRecordProcessor) ProcessRecords(ctx context.Context) error {
+	if !d.deadLetter.enabled() {
+		return d.processPending(ctx)
+	}
+	deadLetterErr := d.retryDeadLetters(ctx)
+	err := d.processPending(ctx)
+	if deadLetterErr != nil {
+		return errors.Join(deadLetterErr, err)
+	}
+	return err
+}
+
+// processPending locks the pending messages, tries to deliver them and then unlocks them
+func (d defaultRecordProcessor) processPending(ctx context.Context) error {
+	err := d.lockUnprocessedEntities(ctx)
+	// Locks are released even when ctx is cancelled so that the records can be claimed again without waiting for the unlocker
+	defer d.store.ClearLocksByLockID(context.WithoutCancel(ctx), d.machineID)
 	if err != nil {
 		return err
 	}
-	records, err := d.store.GetRecordsByLockID(d.machineID)
+	records, err := d.store.GetRecordsByLockID(ctx, d.machineID)
 	if err != nil {
 		return err
 	}
@@ -41,51 +88,298 @@ func (d defaultRecordProcessor) ProcessRecords() error {
 		return nil
 	}
 
-	return d.publishMessages(records)
+	if batchBroker, ok := d.messageBroker.(BatchMessageBroker); ok {
+		return d.publishBatches(ctx, batchBroker, records)
+	}
+	return d.publishMessages(ctx, records)
 }
 
-func (d defaultRecordProcessor) publishMessages(records []Record) error {
-	for _, rec := range records {
-		// Send message to message broker
-		now := d.time.Now().UTC()
-		rec.LastAttemptOn = &now
-		rec.NumberOfAttempts++
-		err := d.messageBroker.Send(rec.Message)
-		// If an error occurs, remove the lock information, update retrial times and continue
-		if err != nil {
-			rec.LockedOn = nil
-			rec.LockID = nil
-			errorMsg := err.Error()
-			rec.Error = &errorMsg
-			if d.retrialPolicy.MaxSendAttemptsEnabled && rec.NumberOfAttempts == d.retrialPolicy.MaxSendAttempts {
-				rec.State = MaxAttemptsReached
+// publishMessages delivers the records using the configured number of send workers.
+// Records of the same group are delivered sequentially and a failure skips the rest of its group, while the
+// other groups are still delivered. The failures of the run are returned as a *BatchError
+func (d defaultRecordProcessor) publishMessages(ctx context.Context, records []Record) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		result   ProcessResult
+		failures []*RecordError
+	)
+	groups := d.groupRecords(records)
+	jobs := make(chan []Record)
+
+	for i := 0; i < min(d.workers, len(groups)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range jobs {
+				delivered, skipped := 0, 0
+				var failure *RecordError
+				for i, rec := range group {
+					// Do not attempt the delivery if the processing was cancelled
+					if ctx.Err() != nil {
+						skipped = len(group) - i
+						break
+					}
+					if err := d.publishMessage(ctx, rec); err != nil {
+						failure = &RecordError{RecordID: rec.ID, Err: err}
+						// The later records of the group must not overtake the failed one
+						skipped = len(group) - i - 1
+						break
+					}
+					delivered++
+				}
+
+				mu.Lock()
+				result.Delivered += delivered
+				result.Skipped += skipped
+				if failure != nil {
+					result.Failed++
+					failures = append(failures, failure)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, group := range groups {
+		jobs <- group
+	}
+	close(jobs)
+	wg.Wait()
+
+	if d.onProcessed != nil {
+		d.onProcessed(result)
+	}
+	if len(failures) > 0 {
+		return &BatchError{ProcessResult: result, Failures: failures}
+	}
+	return ctx.Err()
+}
+
+// publishBatches delivers the records with the batch broker in rounds. Every round sends the next record of each
+// group in a single batch, so the records of a group are still delivered sequentially and a failure skips the rest
+// of its group. The failures of the run are returned as a *BatchError
+func (d defaultRecordProcessor) publishBatches(ctx context.Context, broker BatchMessageBroker, records []Record) error {
+	var (
+		result   ProcessResult
+		failures []*RecordError
+	)
+	groups := d.groupRecords(records)
+	for round := 0; len(groups) > 0; round++ {
+		// Do not attempt the delivery if the processing was cancelled
+		if ctx.Err() != nil {
+			for _, group := range groups {
+				result.Skipped += len(group) - round
+			}
+			break
+		}
+
+		batch := make([]Record, len(groups))
+		messages := make([]Message, len(groups))
+		ids := make([]uuid.UUID, len(groups))
+		for i, group := range groups {
+			batch[i] = d.newAttempt(group[round])
+			messages[i] = batch[i].Message
+			ids[i] = batch[i].ID
+		}
+		sendErrs := broker.SendBatch(ContextWithRecordIDs(ctx, ids), messages)
+		if len(sendErrs) != len(messages) {
+			// The delivery of the messages is unknown, so they are retried
+			err := fmt.Errorf("the batch broker returned %d results for %d messages", len(sendErrs), len(messages))
+			sendErrs = make([]error, len(messages))
+			for i := range sendErrs {
+				sendErrs[i] = err
+			}
+		}
+
+		pending := groups[:0]
+		for i, group := range groups {
+			if err := d.storeOutcome(ctx, batch[i], sendErrs[i]); err != nil {
+				failures = append(failures, &RecordError{RecordID: batch[i].ID, Err: err})
+				result.Failed++
+				// The later records of the group must not overtake the failed one
+				result.Skipped += len(group) - round - 1
+				continue
 			}
-			dbErr := d.store.UpdateRecordByID(rec)
-			if dbErr != nil {
-				return fmt.Errorf("Could not update the record in the db: %w", dbErr)
+			result.Delivered++
+			if round+1 < len(group) {
+				pending = append(pending, group)
 			}
+		}
+		groups = pending
+	}
+
+	if d.onProcessed != nil {
+		d.onProcessed(result)
+	}
+	if len(failures) > 0 {
+		return &BatchError{ProcessResult: result, Failures: failures}
+	}
+	return ctx.Err()
+}
+
+// groupRecords splits the records into groups that have to be delivered sequentially.
+// With KeyOrderedDelivery records sharing a non-empty Message.Key form a group in CreatedOn order, keeping the store
+// order of records with the same CreatedOn, otherwise every record is a group of its own
+func (d defaultRecordProcessor) groupRecords(records []Record) [][]Record {
+	if d.ordering != KeyOrderedDelivery {
+		groups := make([][]Record, len(records))
+		for i, rec := range records {
+			groups[i] = []Record{rec}
+		}
+		return groups
+	}
 
-			return fmt.Errorf("An error occurred when trying to send the message to the broker: %w", err)
+	sorted := make([]Record, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].CreatedOn.Before(sorted[j].CreatedOn)
+	})
+	var groups [][]Record
+	keyGroups := make(map[string]int)
+	for _, rec := range sorted {
+		if rec.Message.Key == "" {
+			groups = append(groups, []Record{rec})
+			continue
 		}
+		i, ok := keyGroups[rec.Message.Key]
+		if !ok {
+			i = len(groups)
+			keyGroups[rec.Message.Key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], rec)
+	}
+	return groups
+}
+
+// publishMessage sends the record to the message broker and stores the outcome
+func (d defaultRecordProcessor) publishMessage(ctx context.Context, rec Record) error {
+	// Send message to message broker
+	rec = d.newAttempt(rec)
+	err := d.messageBroker.Send(ContextWithRecordID(ctx, rec.ID), rec.Message)
+	return d.storeOutcome(ctx, rec, err)
+}
 
-		// Remove lock information and update state
-		rec.State = Delivered
+// newAttempt returns the record with a new delivery attempt starting now
+func (d defaultRecordProcessor) newAttempt(rec Record) Record {
+	now := d.time.Now().UTC()
+	rec.LastAttemptOn = &now
+	rec.NumberOfAttempts++
+	return rec
+}
+
+// storeOutcome stores the outcome of the latest delivery attempt of the record.
+// err is the delivery error of the message broker, nil if the message was delivered
+func (d defaultRecordProcessor) storeOutcome(ctx context.Context, rec Record, err error) error {
+	now := *rec.LastAttemptOn
+	// If an error occurs, remove the lock information, update retrial times and continue
+	if err != nil {
 		rec.LockedOn = nil
 		rec.LockID = nil
-		rec.ProcessedOn = &now
-		err = d.store.UpdateRecordByID(rec)
+		errorMsg := err.Error()
+		rec.Error = &errorMsg
+		var deadLetterErr error
+		deadLettering := false
+		maxAttemptsReached := d.retrialPolicy.MaxSendAttemptsEnabled && rec.NumberOfAttempts == d.retrialPolicy.MaxSendAttempts
+		// Permanent errors are not retried
+		if maxAttemptsReached || IsPermanent(err) {
+			rec.State = MaxAttemptsReached
+			if d.deadLetter.enabled() {
+				deadLettering = true
+				rec, deadLetterErr = d.sendDeadLetter(ctx, rec, now)
+			}
+		} else if d.retrialPolicy.Backoff != nil {
+			nextAttemptOn := now.Add(d.retrialPolicy.Backoff.NextDelay(rec.NumberOfAttempts))
+			rec.NextAttemptOn = &nextAttemptOn
+		}
+		dbErr := d.store.UpdateRecordByID(ctx, rec)
+		if dbErr != nil {
+			return fmt.Errorf("Could not update the record in the db: %w", dbErr)
+		}
+		if deadLettering && d.deadLetter.OnDeadLetter != nil {
+			d.deadLetter.OnDeadLetter(rec, deadLetterErr)
+		}
 
-		if err != nil {
-			return fmt.Errorf("Could not update the record in the db: %w", err)
+		err = fmt.Errorf("An error occurred when trying to send the message to the broker: %w", err)
+		if deadLetterErr != nil {
+			return errors.Join(err, fmt.Errorf("Could not send the message to the dead-letter broker: %w", deadLetterErr))
 		}
+		return err
+	}
+
+	// Remove lock information and update state
+	rec.State = Delivered
+	rec.LockedOn = nil
+	rec.LockID = nil
+	rec.ProcessedOn = &now
+	err = d.store.UpdateRecordByID(ctx, rec)
+
+	if err != nil {
+		return fmt.Errorf("Could not update the record in the db: %w", err)
 	}
 	return nil
 }
 
-// lockUnprocessedEntities updates the messages with the current machine's lockID
-func (d defaultRecordProcessor) lockUnprocessedEntities() error {
+// retryDeadLetters claims the PendingDeadLetter records and sends their dead-letter messages again
+func (d defaultRecordProcessor) retryDeadLetters(ctx context.Context) error {
+	err := d.store.ClaimRecordsByState(ctx, d.machineID, d.time.Now().UTC(), PendingDeadLetter, d.batchSize)
+	defer d.store.ClearLocksByLockID(context.WithoutCancel(ctx), d.machineID)
+	if err != nil {
+		return err
+	}
+	records, err := d.store.GetRecordsByLockID(ctx, d.machineID)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, rec := range records {
+		if ctx.Err() != nil {
+			break
+		}
+		rec.LockedOn = nil
+		rec.LockID = nil
+		var deadLetterErr error
+		rec, deadLetterErr = d.sendDeadLetter(ctx, rec, d.time.Now().UTC())
+		if dbErr := d.store.UpdateRecordByID(ctx, rec); dbErr != nil {
+			errs = append(errs, fmt.Errorf("Could not update the record in the db: %w", dbErr))
+			continue
+		}
+		if d.deadLetter.OnDeadLetter != nil {
+			d.deadLetter.OnDeadLetter(rec, deadLetterErr)
+		}
+		if deadLetterErr != nil {
+			errs = append(errs, fmt.Errorf("Could not send the message to the dead-letter broker: %w", deadLetterErr))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sendDeadLetter sends the dead-letter message of the record and returns the record in DeadLettered, or in
+// PendingDeadLetter with the send error when it failed
+func (d defaultRecordProcessor) sendDeadLetter(ctx context.Context, rec Record, now time2.Time) (Record, error) {
+	if err := d.deadLetter.send(ctx, d.messageBroker, rec); err != nil {
+		rec.State = PendingDeadLetter
+		if d.retrialPolicy.Backoff != nil {
+			nextAttemptOn := now.Add(d.retrialPolicy.Backoff.NextDelay(rec.NumberOfAttempts))
+			rec.NextAttemptOn = &nextAttemptOn
+		}
+		return rec, err
+	}
+	rec.State = DeadLettered
+	rec.ProcessedOn = &now
+	return rec, nil
+}
+
+// lockUnprocessedEntities claims unlocked pending messages with the current machine's lockID
+func (d defaultRecordProcessor) lockUnprocessedEntities(ctx context.Context) error {
 	lockTime := d.time.Now().UTC()
-	lockErr := d.store.UpdateRecordLockByState(d.machineID, lockTime, PendingDelivery)
+	var lockErr error
+	if d.ordering == KeyOrderedDelivery {
+		lockErr = d.store.ClaimKeyOrderedRecordsByState(ctx, d.machineID, lockTime, PendingDelivery, d.batchSize)
+	} else {
+		lockErr = d.store.ClaimRecordsByState(ctx, d.machineID, lockTime, PendingDelivery, d.batchSize)
+	}
 	if lockErr != nil {
 		return lockErr
 	}
@@ -1,6 +1,7 @@
 package outbox
 
 import (
+	"context"
 	"sync"
 
 	"github.com/stretchr/testify/mock"
@@ -11,7 +12,7 @@ type mockRecordProcessor struct {
 	mock.Mock
 }
 
-func (m mockRecordProcessor) ProcessRecords() error {
-	args := m.Called()
+func (m *mockRecordProcessor) ProcessRecords(ctx context.Context) error {
+	args := m.Called(ctx)
 	return args.Error(0)
 }
@@ -1,14 +1,18 @@
 package outbox
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
 	time2 "github.com/pkritiotis/outbox/internal/time"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func TestDefaultRecordProcessor_newProcessor(t *testing.T) {
@@ -16,12 +20,26 @@ func TestDefaultRecordProcessor_newProcessor(t *testing.T) {
 		MaxSendAttemptsEnabled: false,
 		MaxSendAttempts:        0,
 	}
-	p := newProcessor(&MockStore{}, &MockBroker{}, "1", retrialPolicy)
+	p := newProcessor(&MockStore{}, &MockBroker{}, "1", DispatcherSettings{
+		RetrialPolicy: retrialPolicy,
+		MaxBatchSize:  10,
+		SendWorkers:   4,
+		Ordering:      KeyOrderedDelivery,
+	})
 	assert.NotNil(t, p)
 	assert.Equal(t, &MockStore{}, p.store)
 	assert.Equal(t, &MockBroker{}, p.messageBroker)
 	assert.Equal(t, "1", p.machineID)
 	assert.Equal(t, retrialPolicy, p.retrialPolicy)
+	assert.Equal(t, 10, p.batchSize)
+	assert.Equal(t, 4, p.workers)
+	assert.Equal(t, KeyOrderedDelivery, p.ordering)
+}
+
+func TestDefaultRecordProcessor_newProcessor_defaults(t *testing.T) {
+	p := newProcessor(&MockStore{}, &MockBroker{}, "1", DispatcherSettings{})
+	assert.Equal(t, defaultMaxBatchSize, p.batchSize)
+	assert.Equal(t, defaultSendWorkers, p.workers)
 }
 
 func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
@@ -38,6 +56,14 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 		Topic: "testTopic",
 	}
 	machineID := "1"
+	batchSize := 10
+	sampleID := uuid.New()
+	recordFailure := func(err error) error {
+		return &BatchError{
+			ProcessResult: ProcessResult{Failed: 1},
+			Failures:      []*RecordError{{RecordID: sampleID, Err: err}},
+		}
+	}
 	tests := map[string]struct {
 		messageBroker MessageBroker
 		store         Store
@@ -48,15 +74,15 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 		"Eligible records should be processed correctly": {
 			messageBroker: func() *MockBroker {
 				mp := MockBroker{}
-				mp.On("Send", sampleMessage).Return(nil)
+				mp.On("Send", mock.Anything, sampleMessage).Return(nil)
 				return &mp
 			}(),
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("ClaimRecordsByState", mock.Anything, machineID, sampleTime, PendingDelivery, batchSize).Return(nil)
 				recordsToReturn := []Record{
 					{
-						ID:               uuid.New(),
+						ID:               sampleID,
 						Message:          sampleMessage,
 						State:            PendingDelivery,
 						CreatedOn:        time.Now(),
@@ -68,15 +94,15 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 						Error:            nil,
 					},
 				}
-				mp.On("GetRecordsByLockID", machineID).Return(recordsToReturn, nil)
+				mp.On("GetRecordsByLockID", mock.Anything, machineID).Return(recordsToReturn, nil)
 				recordToStore := recordsToReturn[0]
 				recordToStore.State = Delivered
 				recordToStore.LastAttemptOn = &sampleTime
 				recordToStore.LockID = nil
 				recordToStore.NumberOfAttempts++
 				recordToStore.ProcessedOn = &sampleTime
-				mp.On("UpdateRecordByID", recordToStore).Return(nil)
-				mp.On("ClearLocksByLockID", machineID).Return(nil)
+				mp.On("UpdateRecordByID", mock.Anything, recordToStore).Return(nil)
+				mp.On("ClearLocksByLockID", mock.Anything, machineID).Return(nil)
 				return &mp
 			}(),
 			machineID: machineID,
@@ -90,10 +116,10 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 			messageBroker: &MockBroker{},
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("ClaimRecordsByState", mock.Anything, machineID, sampleTime, PendingDelivery, batchSize).Return(nil)
 				recordsToReturn := []Record{}
-				mp.On("GetRecordsByLockID", machineID).Return(recordsToReturn, nil)
-				mp.On("ClearLocksByLockID", machineID).Return(nil)
+				mp.On("GetRecordsByLockID", mock.Anything, machineID).Return(recordsToReturn, nil)
+				mp.On("ClearLocksByLockID", mock.Anything, machineID).Return(nil)
 				return &mp
 			}(),
 			machineID: machineID,
@@ -107,9 +133,9 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 			messageBroker: &MockBroker{},
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).
+				mp.On("ClaimRecordsByState", mock.Anything, machineID, sampleTime, PendingDelivery, batchSize).
 					Return(errors.New("lock error"))
-				mp.On("ClearLocksByLockID", machineID).Return(nil)
+				mp.On("ClearLocksByLockID", mock.Anything, machineID).Return(nil)
 
 				return &mp
 			}(),
@@ -124,10 +150,10 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 			messageBroker: &MockBroker{},
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("ClaimRecordsByState", mock.Anything, machineID, sampleTime, PendingDelivery, batchSize).Return(nil)
 				recordsToReturn := []Record{
 					{
-						ID:               uuid.New(),
+						ID:               sampleID,
 						Message:          sampleMessage,
 						State:            PendingDelivery,
 						CreatedOn:        time.Now(),
@@ -139,9 +165,9 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 						Error:            nil,
 					},
 				}
-				mp.On("GetRecordsByLockID", machineID).
+				mp.On("GetRecordsByLockID", mock.Anything, machineID).
 					Return(recordsToReturn, errors.New("get error"))
-				mp.On("ClearLocksByLockID", machineID).Return(nil)
+				mp.On("ClearLocksByLockID", mock.Anything, machineID).Return(nil)
 
 				return &mp
 			}(),
@@ -155,15 +181,15 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 		"Error in Update should return an error": {
 			messageBroker: func() *MockBroker {
 				mp := MockBroker{}
-				mp.On("Send", sampleMessage).Return(nil)
+				mp.On("Send", mock.Anything, sampleMessage).Return(nil)
 				return &mp
 			}(),
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("ClaimRecordsByState", mock.Anything, machineID, sampleTime, PendingDelivery, batchSize).Return(nil)
 				recordsToReturn := []Record{
 					{
-						ID:               uuid.New(),
+						ID:               sampleID,
 						Message:          sampleMessage,
 						State:            PendingDelivery,
 						CreatedOn:        time.Now(),
@@ -175,16 +201,16 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 						Error:            nil,
 					},
 				}
-				mp.On("GetRecordsByLockID", machineID).Return(recordsToReturn, nil)
+				mp.On("GetRecordsByLockID", mock.Anything, machineID).Return(recordsToReturn, nil)
 				recordToStore := recordsToReturn[0]
 				recordToStore.State = Delivered
 				recordToStore.LastAttemptOn = &sampleTime
 				recordToStore.LockID = nil
 				recordToStore.NumberOfAttempts++
 				recordToStore.ProcessedOn = &sampleTime
-				mp.On("UpdateRecordByID", recordToStore).
+				mp.On("UpdateRecordByID", mock.Anything, recordToStore).
 					Return(errors.New("update error"))
-				mp.On("ClearLocksByLockID", machineID).Return(nil)
+				mp.On("ClearLocksByLockID", mock.Anything, machineID).Return(nil)
 
 				return &mp
 			}(),
@@ -193,20 +219,20 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 				MaxSendAttemptsEnabled: true,
 				MaxSendAttempts:        3,
 			},
-			expErr: fmt.Errorf("Could not update the record in the db: %w", errors.New("update error")),
+			expErr: recordFailure(fmt.Errorf("Could not update the record in the db: %w", errors.New("update error"))),
 		},
 		"Error in Clear locks should not return an error": {
 			messageBroker: func() *MockBroker {
 				mp := MockBroker{}
-				mp.On("Send", sampleMessage).Return(nil)
+				mp.On("Send", mock.Anything, sampleMessage).Return(nil)
 				return &mp
 			}(),
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("ClaimRecordsByState", mock.Anything, machineID, sampleTime, PendingDelivery, batchSize).Return(nil)
 				recordsToReturn := []Record{
 					{
-						ID:               uuid.New(),
+						ID:               sampleID,
 						Message:          sampleMessage,
 						State:            PendingDelivery,
 						CreatedOn:        time.Now(),
@@ -218,15 +244,15 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 						Error:            nil,
 					},
 				}
-				mp.On("GetRecordsByLockID", machineID).Return(recordsToReturn, nil)
+				mp.On("GetRecordsByLockID", mock.Anything, machineID).Return(recordsToReturn, nil)
 				recordToStore := recordsToReturn[0]
 				recordToStore.State = Delivered
 				recordToStore.LastAttemptOn = &sampleTime
 				recordToStore.LockID = nil
 				recordToStore.NumberOfAttempts++
 				recordToStore.ProcessedOn = &sampleTime
-				mp.On("UpdateRecordByID", recordToStore).Return(nil)
-				mp.On("ClearLocksByLockID", machineID).
+				mp.On("UpdateRecordByID", mock.Anything, recordToStore).Return(nil)
+				mp.On("ClearLocksByLockID", mock.Anything, machineID).
 					Return(errors.New("clear locks error"))
 				return &mp
 			}(),
@@ -240,15 +266,15 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 		"Error in broker with retrial disabled send should not change the state and return an error": {
 			messageBroker: func() *MockBroker {
 				mp := MockBroker{}
-				mp.On("Send", sampleMessage).Return(errors.New("message broker error"))
+				mp.On("Send", mock.Anything, sampleMessage).Return(errors.New("message broker error"))
 				return &mp
 			}(),
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("ClaimRecordsByState", mock.Anything, machineID, sampleTime, PendingDelivery, batchSize).Return(nil)
 				recordsToReturn := []Record{
 					{
-						ID:               uuid.New(),
+						ID:               sampleID,
 						Message:          sampleMessage,
 						State:            PendingDelivery,
 						CreatedOn:        time.Now(),
@@ -260,7 +286,7 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 						Error:            nil,
 					},
 				}
-				mp.On("GetRecordsByLockID", machineID).Return(recordsToReturn, nil)
+				mp.On("GetRecordsByLockID", mock.Anything, machineID).Return(recordsToReturn, nil)
 				recordToStore := recordsToReturn[0]
 				recordToStore.State = PendingDelivery
 				recordToStore.LastAttemptOn = &sampleTime
@@ -268,8 +294,8 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 				recordToStore.NumberOfAttempts++
 				errMsg := "message broker error"
 				recordToStore.Error = &errMsg
-				mp.On("UpdateRecordByID", recordToStore).Return(nil)
-				mp.On("ClearLocksByLockID", machineID).Return(nil)
+				mp.On("UpdateRecordByID", mock.Anything, recordToStore).Return(nil)
+				mp.On("ClearLocksByLockID", mock.Anything, machineID).Return(nil)
 				return &mp
 			}(),
 			machineID: machineID,
@@ -277,20 +303,60 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 				MaxSendAttemptsEnabled: false,
 				MaxSendAttempts:        3,
 			},
-			expErr: fmt.Errorf("An error occurred when trying to send the message to the broker: %w", errors.New("message broker error")),
+			expErr: recordFailure(fmt.Errorf("An error occurred when trying to send the message to the broker: %w", errors.New("message broker error"))),
+		},
+		"Error in broker with backoff should schedule the next attempt and return an error": {
+			messageBroker: func() *MockBroker {
+				mp := MockBroker{}
+				mp.On("Send", mock.Anything, sampleMessage).Return(errors.New("message broker error"))
+				return &mp
+			}(),
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("ClaimRecordsByState", mock.Anything, machineID, sampleTime, PendingDelivery, batchSize).Return(nil)
+				recordsToReturn := []Record{
+					{
+						ID:               sampleID,
+						Message:          sampleMessage,
+						State:            PendingDelivery,
+						CreatedOn:        time.Now(),
+						LockID:           &machineID,
+						NumberOfAttempts: 1,
+					},
+				}
+				mp.On("GetRecordsByLockID", mock.Anything, machineID).Return(recordsToReturn, nil)
+				recordToStore := recordsToReturn[0]
+				recordToStore.LastAttemptOn = &sampleTime
+				recordToStore.LockID = nil
+				recordToStore.NumberOfAttempts++
+				errMsg := "message broker error"
+				recordToStore.Error = &errMsg
+				nextAttemptOn := sampleTime.Add(4 * time.Minute)
+				recordToStore.NextAttemptOn = &nextAttemptOn
+				mp.On("UpdateRecordByID", mock.Anything, recordToStore).Return(nil)
+				mp.On("ClearLocksByLockID", mock.Anything, machineID).Return(nil)
+				return &mp
+			}(),
+			machineID: machineID,
+			retrialPolicy: RetrialPolicy{
+				MaxSendAttemptsEnabled: true,
+				MaxSendAttempts:        3,
+				Backoff:                LinearBackoff{Initial: 2 * time.Minute, Increment: 2 * time.Minute},
+			},
+			expErr: recordFailure(fmt.Errorf("An error occurred when trying to send the message to the broker: %w", errors.New("message broker error"))),
 		},
 		"Error in broker and subsequent error in update should return an error": {
 			messageBroker: func() *MockBroker {
 				mp := MockBroker{}
-				mp.On("Send", sampleMessage).Return(errors.New("message broker error"))
+				mp.On("Send", mock.Anything, sampleMessage).Return(errors.New("message broker error"))
 				return &mp
 			}(),
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("ClaimRecordsByState", mock.Anything, machineID, sampleTime, PendingDelivery, batchSize).Return(nil)
 				recordsToReturn := []Record{
 					{
-						ID:               uuid.New(),
+						ID:               sampleID,
 						Message:          sampleMessage,
 						State:            PendingDelivery,
 						CreatedOn:        time.Now(),
@@ -302,7 +368,7 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 						Error:            nil,
 					},
 				}
-				mp.On("GetRecordsByLockID", machineID).Return(recordsToReturn, nil)
+				mp.On("GetRecordsByLockID", mock.Anything, machineID).Return(recordsToReturn, nil)
 				recordToStore := recordsToReturn[0]
 				recordToStore.State = PendingDelivery
 				recordToStore.LastAttemptOn = &sampleTime
@@ -310,8 +376,8 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 				recordToStore.NumberOfAttempts++
 				errMsg := "message broker error"
 				recordToStore.Error = &errMsg
-				mp.On("UpdateRecordByID", recordToStore).Return(errors.New("db error"))
-				mp.On("ClearLocksByLockID", machineID).Return(nil)
+				mp.On("UpdateRecordByID", mock.Anything, recordToStore).Return(errors.New("db error"))
+				mp.On("ClearLocksByLockID", mock.Anything, machineID).Return(nil)
 				return &mp
 			}(),
 			machineID: machineID,
@@ -319,20 +385,20 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 				MaxSendAttemptsEnabled: false,
 				MaxSendAttempts:        3,
 			},
-			expErr: fmt.Errorf("Could not update the record in the db: %w", errors.New("db error")),
+			expErr: recordFailure(fmt.Errorf("Could not update the record in the db: %w", errors.New("db error"))),
 		},
 		"Error in broker with retrial enabled send should change the state and return an error": {
 			messageBroker: func() *MockBroker {
 				mp := MockBroker{}
-				mp.On("Send", sampleMessage).Return(errors.New("message broker error"))
+				mp.On("Send", mock.Anything, sampleMessage).Return(errors.New("message broker error"))
 				return &mp
 			}(),
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("UpdateRecordLockByState", machineID, sampleTime, PendingDelivery).Return(nil)
+				mp.On("ClaimRecordsByState", mock.Anything, machineID, sampleTime, PendingDelivery, batchSize).Return(nil)
 				recordsToReturn := []Record{
 					{
-						ID:               uuid.New(),
+						ID:               sampleID,
 						Message:          sampleMessage,
 						State:            PendingDelivery,
 						CreatedOn:        time.Now(),
@@ -344,7 +410,7 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 						Error:            nil,
 					},
 				}
-				mp.On("GetRecordsByLockID", machineID).Return(recordsToReturn, nil)
+				mp.On("GetRecordsByLockID", mock.Anything, machineID).Return(recordsToReturn, nil)
 				recordToStore := recordsToReturn[0]
 				recordToStore.State = MaxAttemptsReached
 				recordToStore.LastAttemptOn = &sampleTime
@@ -352,8 +418,8 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 				recordToStore.NumberOfAttempts++
 				errMsg := "message broker error"
 				recordToStore.Error = &errMsg
-				mp.On("UpdateRecordByID", recordToStore).Return(nil)
-				mp.On("ClearLocksByLockID", machineID).Return(nil)
+				mp.On("UpdateRecordByID", mock.Anything, recordToStore).Return(nil)
+				mp.On("ClearLocksByLockID", mock.Anything, machineID).Return(nil)
 				return &mp
 			}(),
 			machineID: machineID,
@@ -361,7 +427,7 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 				MaxSendAttemptsEnabled: true,
 				MaxSendAttempts:        1,
 			},
-			expErr: fmt.Errorf("An error occurred when trying to send the message to the broker: %w", errors.New("message broker error")),
+			expErr: recordFailure(fmt.Errorf("An error occurred when trying to send the message to the broker: %w", errors.New("message broker error"))),
 		},
 	}
 	for name, test := range tests {
@@ -373,9 +439,420 @@ func Test_defaultRecordProcessor_ProcessRecords(t *testing.T) {
 				store:         tt.store,
 				machineID:     tt.machineID,
 				retrialPolicy: tt.retrialPolicy,
+				batchSize:     batchSize,
+				workers:       1,
 			}
-			err := d.ProcessRecords()
+			err := d.ProcessRecords(context.Background())
 			assert.Equal(t, tt.expErr, err)
 		})
 	}
 }
+
+func Test_defaultRecordProcessor_ProcessRecords_cancelled(t *testing.T) {
+	sampleTime := time.Now().UTC()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	machineID := "1"
+	batchSize := 10
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	store := &MockStore{}
+	store.On("ClaimRecordsByState", ctx, machineID, sampleTime, PendingDelivery, batchSize).Return(nil)
+	store.On("GetRecordsByLockID", ctx, machineID).Return([]Record{{ID: uuid.New(), State: PendingDelivery}}, nil)
+	store.On("ClearLocksByLockID", mock.Anything, machineID).Return(nil)
+	broker := &MockBroker{}
+	d := defaultRecordProcessor{
+		messageBroker: broker,
+		time:          timeProvider,
+		store:         store,
+		machineID:     machineID,
+		batchSize:     batchSize,
+		workers:       1,
+	}
+
+	err := d.ProcessRecords(ctx)
+
+	assert.Equal(t, context.Canceled, err)
+	broker.AssertNotCalled(t, "Send", mock.Anything, mock.Anything)
+	store.AssertNotCalled(t, "UpdateRecordByID", mock.Anything, mock.Anything)
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_concurrentWorkers(t *testing.T) {
+	records := make([]Record, 20)
+	for i := range records {
+		records[i] = Record{ID: uuid.New(), Message: Message{Key: fmt.Sprint(i)}, State: PendingDelivery}
+	}
+	store := &stubStore{records: records}
+	broker := &slowBroker{delay: 10 * time.Millisecond}
+	d := newProcessor(store, broker, "1", DispatcherSettings{MaxBatchSize: len(records), SendWorkers: len(records)})
+
+	err := d.ProcessRecords(context.Background())
+
+	assert.Nil(t, err)
+	assert.Greater(t, broker.peakInFlight(), 1)
+	assert.Len(t, store.updated, len(records))
+	for _, rec := range store.updated {
+		assert.Equal(t, Delivered, rec.State)
+	}
+}
+
+func BenchmarkDefaultRecordProcessor_ProcessRecords(b *testing.B) {
+	records := make([]Record, 100)
+	for i := range records {
+		records[i] = Record{ID: uuid.New(), State: PendingDelivery}
+	}
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			d := newProcessor(&stubStore{records: records}, &slowBroker{delay: time.Millisecond}, "1", DispatcherSettings{MaxBatchSize: len(records), SendWorkers: workers})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := d.ProcessRecords(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N*len(records))/b.Elapsed().Seconds(), "records/s")
+		})
+	}
+	b.Run("batch", func(b *testing.B) {
+		d := newProcessor(&stubStore{records: records}, &slowBatchBroker{slowBroker{delay: time.Millisecond}}, "1", DispatcherSettings{MaxBatchSize: len(records)})
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := d.ProcessRecords(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.N*len(records))/b.Elapsed().Seconds(), "records/s")
+	})
+}
+
+// slowBatchBroker simulates a remote message broker that delivers a whole batch in a single round trip
+type slowBatchBroker struct {
+	slowBroker
+}
+
+func (s *slowBatchBroker) SendBatch(ctx context.Context, messages []Message) []error {
+	err := s.Send(ctx, Message{})
+	errs := make([]error, len(messages))
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// slowBroker simulates the round trip of a remote message broker and keeps the peak number of concurrent sends
+type slowBroker struct {
+	delay time.Duration
+
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func (s *slowBroker) Send(ctx context.Context, _ Message) error {
+	s.mu.Lock()
+	s.inFlight++
+	s.peak = max(s.peak, s.inFlight)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}()
+	select {
+	case <-time.After(s.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *slowBroker) peakInFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peak
+}
+
+// stubStore returns the same records on every claim and keeps the updated records
+// stubStore returns the records with the last claimed state as the locked records and keeps the updated records
+type stubStore struct {
+	mu      sync.Mutex
+	records []Record
+	updated []Record
+	claimed RecordState
+}
+
+func (s *stubStore) AddRecordTx(context.Context, Record, *sql.Tx) error { return nil }
+
+func (s *stubStore) GetRecordsByLockID(context.Context, string) ([]Record, error) {
+	var records []Record
+	for _, rec := range s.records {
+		if rec.State == s.claimed {
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+func (s *stubStore) UpdateRecordLockByState(context.Context, string, time.Time, RecordState) error {
+	return nil
+}
+
+func (s *stubStore) ClaimRecordsByState(_ context.Context, _ string, _ time.Time, state RecordState, _ int) error {
+	s.claimed = state
+	return nil
+}
+
+func (s *stubStore) ClaimKeyOrderedRecordsByState(_ context.Context, _ string, _ time.Time, state RecordState, _ int) error {
+	s.claimed = state
+	return nil
+}
+
+func (s *stubStore) UpdateRecordByID(_ context.Context, rec Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updated = append(s.updated, rec)
+	return nil
+}
+
+func (s *stubStore) ClearLocksWithDurationBeforeDate(context.Context, time.Time) error { return nil }
+
+func (s *stubStore) ClearLocksByLockID(context.Context, string) error { return nil }
+
+func (s *stubStore) RequeueRecords(context.Context, RequeueFilter, string, time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (s *stubStore) RemoveRecordsBeforeDatetime(context.Context, time.Time) error { return nil }
+
+func Test_defaultRecordProcessor_ProcessRecords_keyOrdered(t *testing.T) {
+	now := time.Now().UTC()
+	newRecord := func(key string, body string, createdOn time.Time) Record {
+		return Record{ID: uuid.New(), Message: Message{Key: key, Body: []byte(body)}, State: PendingDelivery, CreatedOn: createdOn}
+	}
+	records := []Record{
+		newRecord("k1", "k1-3", now.Add(3*time.Second)),
+		newRecord("k2", "k2-1", now.Add(1*time.Second)),
+		newRecord("k1", "k1-1", now),
+		newRecord("k3", "k3-1", now),
+		newRecord("k3", "k3-2", now.Add(time.Second)),
+		newRecord("k1", "k1-2", now.Add(2*time.Second)),
+		newRecord("", "no-key", now),
+	}
+	broker := &recordingBroker{failing: map[string]bool{"k3-1": true}}
+	store := &stubStore{records: records}
+	d := newProcessor(store, broker, "1", DispatcherSettings{SendWorkers: 4, Ordering: KeyOrderedDelivery})
+
+	err := d.ProcessRecords(context.Background())
+
+	var batchErr *BatchError
+	assert.ErrorAs(t, err, &batchErr)
+	assert.Equal(t, ProcessResult{Delivered: 5, Failed: 1, Skipped: 1}, batchErr.ProcessResult)
+	assert.EqualError(t, errors.Unwrap(batchErr.Failures[0]), "An error occurred when trying to send the message to the broker: k3-1 failed")
+	assert.Equal(t, []string{"k1-1", "k1-2", "k1-3"}, broker.sentByKey["k1"])
+	assert.Equal(t, []string{"k2-1"}, broker.sentByKey["k2"])
+	assert.Equal(t, []string{"k3-1"}, broker.sentByKey["k3"])
+	assert.Equal(t, []string{"no-key"}, broker.sentByKey[""])
+	assert.Len(t, store.updated, 6)
+}
+
+// recordingBroker keeps the message bodies sent per key and fails the messages with the provided bodies
+type recordingBroker struct {
+	mu        sync.Mutex
+	failing   map[string]bool
+	sentByKey map[string][]string
+}
+
+func (r *recordingBroker) Send(_ context.Context, msg Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sentByKey == nil {
+		r.sentByKey = make(map[string][]string)
+	}
+	r.sentByKey[msg.Key] = append(r.sentByKey[msg.Key], string(msg.Body))
+	if r.failing[string(msg.Body)] {
+		return fmt.Errorf("%s failed", msg.Body)
+	}
+	return nil
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_recordIDInContext(t *testing.T) {
+	records := []Record{{ID: uuid.New(), State: PendingDelivery}}
+	broker := &MockBroker{}
+	broker.On("Send", mock.MatchedBy(func(ctx context.Context) bool {
+		id, ok := RecordIDFromContext(ctx)
+		return ok && id == records[0].ID
+	}), records[0].Message).Return(nil)
+	d := newProcessor(&stubStore{records: records}, broker, "1", DispatcherSettings{})
+
+	err := d.ProcessRecords(context.Background())
+
+	assert.Nil(t, err)
+	broker.AssertExpectations(t)
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_continuesAfterFailure(t *testing.T) {
+	records := []Record{
+		{ID: uuid.New(), Message: Message{Body: []byte("first")}, State: PendingDelivery},
+		{ID: uuid.New(), Message: Message{Body: []byte("poison")}, State: PendingDelivery},
+		{ID: uuid.New(), Message: Message{Body: []byte("last")}, State: PendingDelivery},
+	}
+	broker := &recordingBroker{failing: map[string]bool{"poison": true}}
+	store := &stubStore{records: records}
+	var result ProcessResult
+	d := newProcessor(store, broker, "1", DispatcherSettings{
+		OnProcessed: func(r ProcessResult) {
+			result = r
+		},
+	})
+
+	err := d.ProcessRecords(context.Background())
+
+	assert.Equal(t, []string{"first", "poison", "last"}, broker.sentByKey[""])
+	assert.Equal(t, ProcessResult{Delivered: 2, Failed: 1}, result)
+	var recErr *RecordError
+	assert.ErrorAs(t, err, &recErr)
+	assert.Equal(t, records[1].ID, recErr.RecordID)
+	assert.EqualError(t, err, fmt.Sprintf("1 records failed, 2 delivered, 0 skipped: record %v: An error occurred when trying to send the message to the broker: poison failed", records[1].ID))
+	assert.Len(t, store.updated, 3)
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_batchBroker(t *testing.T) {
+	now := time.Now().UTC()
+	newRecord := func(key string, body string, createdOn time.Time) Record {
+		return Record{ID: uuid.New(), Message: Message{Key: key, Body: []byte(body)}, State: PendingDelivery, CreatedOn: createdOn}
+	}
+	records := []Record{
+		newRecord("k1", "k1-1", now),
+		newRecord("k1", "k1-2", now.Add(time.Second)),
+		newRecord("k1", "k1-3", now.Add(2*time.Second)),
+		newRecord("k2", "k2-1", now),
+		newRecord("k2", "k2-2", now.Add(time.Second)),
+		newRecord("k3", "k3-1", now),
+	}
+	tests := map[string]struct {
+		ordering      DeliveryOrdering
+		expBatchSizes []int
+		expResult     ProcessResult
+		expSentByKey  map[string][]string
+	}{
+		"Unordered delivery should send all the records in a single batch": {
+			ordering:      UnorderedDelivery,
+			expBatchSizes: []int{6},
+			expResult:     ProcessResult{Delivered: 5, Failed: 1},
+			expSentByKey: map[string][]string{
+				"k1": {"k1-1", "k1-2", "k1-3"},
+				"k2": {"k2-1", "k2-2"},
+				"k3": {"k3-1"},
+			},
+		},
+		"Key ordered delivery should send the records of a key in consecutive batches": {
+			ordering:      KeyOrderedDelivery,
+			expBatchSizes: []int{3, 1, 1},
+			expResult:     ProcessResult{Delivered: 4, Failed: 1, Skipped: 1},
+			expSentByKey: map[string][]string{
+				"k1": {"k1-1", "k1-2", "k1-3"},
+				"k2": {"k2-1"},
+				"k3": {"k3-1"},
+			},
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			broker := &recordingBatchBroker{recordingBroker: recordingBroker{failing: map[string]bool{"k2-1": true}}}
+			store := &stubStore{records: records}
+			var result ProcessResult
+			d := newProcessor(store, broker, "1", DispatcherSettings{
+				Ordering: tt.ordering,
+				OnProcessed: func(r ProcessResult) {
+					result = r
+				},
+			})
+
+			err := d.ProcessRecords(context.Background())
+
+			var batchErr *BatchError
+			assert.ErrorAs(t, err, &batchErr)
+			assert.Equal(t, records[3].ID, batchErr.Failures[0].RecordID)
+			assert.Equal(t, tt.expResult, result)
+			assert.Equal(t, tt.expBatchSizes, broker.batchSizes)
+			assert.Equal(t, tt.expSentByKey, broker.sentByKey)
+			assert.Len(t, store.updated, tt.expResult.Delivered+tt.expResult.Failed)
+		})
+	}
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_batchBrokerResultMismatch(t *testing.T) {
+	records := []Record{
+		{ID: uuid.New(), Message: Message{Body: []byte("first")}, State: PendingDelivery},
+		{ID: uuid.New(), Message: Message{Body: []byte("second")}, State: PendingDelivery},
+	}
+	store := &stubStore{records: records}
+	d := newProcessor(store, shortBatchBroker{}, "1", DispatcherSettings{})
+
+	err := d.ProcessRecords(context.Background())
+
+	var batchErr *BatchError
+	assert.ErrorAs(t, err, &batchErr)
+	assert.Equal(t, ProcessResult{Failed: 2}, batchErr.ProcessResult)
+	assert.EqualError(t, errors.Unwrap(batchErr.Failures[0]), "An error occurred when trying to send the message to the broker: the batch broker returned 0 results for 2 messages")
+	for _, rec := range store.updated {
+		assert.Equal(t, PendingDelivery, rec.State)
+		assert.Equal(t, 1, rec.NumberOfAttempts)
+	}
+}
+
+func Test_defaultRecordProcessor_ProcessRecords_batchBrokerRecordIDs(t *testing.T) {
+	records := []Record{
+		{ID: uuid.New(), Message: Message{Key: "k1", Body: []byte("k1-1")}, State: PendingDelivery},
+		{ID: uuid.New(), Message: Message{Key: "k1", Body: []byte("k1-2")}, State: PendingDelivery},
+		{ID: uuid.New(), Message: Message{Key: "k2", Body: []byte("k2-1")}, State: PendingDelivery},
+	}
+	broker := &recordingBatchBroker{}
+	d := newProcessor(&stubStore{records: records}, broker, "1", DispatcherSettings{Ordering: KeyOrderedDelivery})
+
+	err := d.ProcessRecords(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, [][]uuid.UUID{{records[0].ID, records[2].ID}, {records[1].ID}}, broker.recordIDs)
+}
+
+// recordingBatchBroker is a recordingBroker that also keeps the size and the record ids of every batch
+type recordingBatchBroker struct {
+	recordingBroker
+	batchSizes []int
+	recordIDs  [][]uuid.UUID
+}
+
+func (r *recordingBatchBroker) SendBatch(ctx context.Context, messages []Message) []error {
+	r.batchSizes = append(r.batchSizes, len(messages))
+	ids, _ := RecordIDsFromContext(ctx)
+	r.recordIDs = append(r.recordIDs, ids)
+	errs := make([]error, len(messages))
+	for i, msg := range messages {
+		errs[i] = r.Send(ctx, msg)
+	}
+	return errs
+}
+
+// shortBatchBroker is a batch broker that does not return any results
+type shortBatchBroker struct{}
+
+func (shortBatchBroker) Send(context.Context, Message) error { return nil }
+
+func (shortBatchBroker) SendBatch(context.Context, []Message) []error { return nil }
+
+func TestBatchError_Is(t *testing.T) {
+	errBroker := errors.New("broker error")
+	err := &BatchError{
+		ProcessResult: ProcessResult{Failed: 2},
+		Failures: []*RecordError{
+			{RecordID: uuid.New(), Err: errors.New("other error")},
+			{RecordID: uuid.New(), Err: fmt.Errorf("wrapped: %w", errBroker)},
+		},
+	}
+
+	assert.ErrorIs(t, err, errBroker)
+	assert.Contains(t, err.Error(), "(and 1 more)")
+}
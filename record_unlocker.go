@@ -1,6 +1,7 @@
 package outbox
 
 import (
+	"context"
 	time2 "time"
 
 	"github.com/pkritiotis/outbox/internal/time"
@@ -16,9 +17,9 @@ func newRecordUnlocker(store Store, maxLockTimeDurationMins time2.Duration) reco
 	return recordUnlocker{MaxLockTimeDurationMins: maxLockTimeDurationMins, store: store, time: time.NewTimeProvider()}
 }
 
-func (d recordUnlocker) UnlockExpiredMessages() error {
+func (d recordUnlocker) UnlockExpiredMessages(ctx context.Context) error {
 	expiryTime := d.time.Now().UTC().Add(-d.MaxLockTimeDurationMins)
-	clearErr := d.store.ClearLocksWithDurationBeforeDate(expiryTime)
+	clearErr := d.store.ClearLocksWithDurationBeforeDate(ctx, expiryTime)
 	if clearErr != nil {
 		return clearErr
 	}
@@ -1,6 +1,8 @@
 package outbox
 
 import (
+	"context"
+
 	"github.com/stretchr/testify/mock"
 )
 
@@ -8,7 +10,7 @@ type mockRecordUnlocker struct {
 	mock.Mock
 }
 
-func (m *mockRecordUnlocker) UnlockExpiredMessages() error {
-	args := m.Called()
+func (m *mockRecordUnlocker) UnlockExpiredMessages(ctx context.Context) error {
+	args := m.Called(ctx)
 	return args.Error(0)
 }
@@ -1,12 +1,14 @@
 package outbox
 
 import (
+	"context"
 	"errors"
 	"testing"
 	time2 "time"
 
 	"github.com/pkritiotis/outbox/internal/time"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func Test_recordUnlocker_unlockExpiredMessages(t *testing.T) {
@@ -23,7 +25,7 @@ func Test_recordUnlocker_unlockExpiredMessages(t *testing.T) {
 		"Successful unlocking should not return error": {
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("ClearLocksWithDurationBeforeDate", sampleTime.Add(-2*time2.Minute)).Return(nil)
+				mp.On("ClearLocksWithDurationBeforeDate", mock.Anything, sampleTime.Add(-2*time2.Minute)).Return(nil)
 				return &mp
 			}(),
 			time:                    timeProvider,
@@ -33,7 +35,7 @@ func Test_recordUnlocker_unlockExpiredMessages(t *testing.T) {
 		"Error in unlocking should return error": {
 			store: func() *MockStore {
 				mp := MockStore{}
-				mp.On("ClearLocksWithDurationBeforeDate", sampleTime.Add(-2*time2.Minute)).Return(errors.New("test"))
+				mp.On("ClearLocksWithDurationBeforeDate", mock.Anything, sampleTime.Add(-2*time2.Minute)).Return(errors.New("test"))
 				return &mp
 			}(),
 			time:                    timeProvider,
@@ -49,7 +51,7 @@ func Test_recordUnlocker_unlockExpiredMessages(t *testing.T) {
 				time:                    tt.time,
 				MaxLockTimeDurationMins: tt.MaxLockTimeDurationMins,
 			}
-			err := d.UnlockExpiredMessages()
+			err := d.UnlockExpiredMessages(context.Background())
 			assert.Equal(t, tt.expErr, err)
 		})
 	}
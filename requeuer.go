@@ -0,0 +1,77 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	time2 "time"
+
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox/internal/time"
+)
+
+// ErrEmptyRequeueFilter is returned when a requeue is requested without any criteria
+var ErrEmptyRequeueFilter = errors.New("the requeue filter must contain at least one criterion")
+
+// RequeueFilter selects the records to requeue. A record is selected when it matches all the set fields
+type RequeueFilter struct {
+	// IDs of the records
+	IDs []uuid.UUID
+	// Topic of the record message
+	Topic string
+	// CreatedFrom is the inclusive lower bound of the record CreatedOn
+	CreatedFrom time2.Time
+	// CreatedTo is the exclusive upper bound of the record CreatedOn
+	CreatedTo time2.Time
+	// ErrorContains is a substring of the last delivery error of the record
+	ErrorContains string
+	// States of the records. Defaults to Delivered, MaxAttemptsReached, DeadLettered and PendingDeadLetter
+	States []RecordState
+}
+
+func (f RequeueFilter) empty() bool {
+	return len(f.IDs) == 0 && f.Topic == "" && f.CreatedFrom.IsZero() && f.CreatedTo.IsZero() && f.ErrorContains == ""
+}
+
+// Requeuer moves failed or delivered records back to PendingDelivery so that the dispatcher delivers them again.
+// The attempts, the error and the next attempt time of the records are reset and the requeue is recorded
+// in Record.RequeuedBy and Record.RequeuedOn
+type Requeuer struct {
+	store Store
+	time  time.Provider
+}
+
+// NewRequeuer is the Requeuer constructor
+func NewRequeuer(store Store) Requeuer {
+	return Requeuer{store: store, time: time.NewTimeProvider()}
+}
+
+// RequeueByID requeues the records with the provided ids and returns the number of requeued records
+func (r Requeuer) RequeueByID(ctx context.Context, requeuedBy string, ids ...uuid.UUID) (int64, error) {
+	return r.Requeue(ctx, requeuedBy, RequeueFilter{IDs: ids})
+}
+
+// RequeueByTopic requeues the records of the provided topic and returns the number of requeued records
+func (r Requeuer) RequeueByTopic(ctx context.Context, requeuedBy string, topic string) (int64, error) {
+	return r.Requeue(ctx, requeuedBy, RequeueFilter{Topic: topic})
+}
+
+// RequeueByTimeRange requeues the records created within [from, to) and returns the number of requeued records
+func (r Requeuer) RequeueByTimeRange(ctx context.Context, requeuedBy string, from time2.Time, to time2.Time) (int64, error) {
+	return r.Requeue(ctx, requeuedBy, RequeueFilter{CreatedFrom: from, CreatedTo: to})
+}
+
+// RequeueByError requeues the records whose last error contains errorSubstring and returns the number of requeued records
+func (r Requeuer) RequeueByError(ctx context.Context, requeuedBy string, errorSubstring string) (int64, error) {
+	return r.Requeue(ctx, requeuedBy, RequeueFilter{ErrorContains: errorSubstring})
+}
+
+// Requeue requeues the records that match the provided filter and returns the number of requeued records
+func (r Requeuer) Requeue(ctx context.Context, requeuedBy string, filter RequeueFilter) (int64, error) {
+	if filter.empty() {
+		return 0, ErrEmptyRequeueFilter
+	}
+	if len(filter.States) == 0 {
+		filter.States = []RecordState{Delivered, MaxAttemptsReached, DeadLettered, PendingDeadLetter}
+	}
+	return r.store.RequeueRecords(ctx, filter, requeuedBy, r.time.Now().UTC())
+}
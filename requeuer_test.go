@@ -0,0 +1,135 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	time2 "github.com/pkritiotis/outbox/internal/time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNewRequeuer(t *testing.T) {
+	store := &MockStore{}
+	expRequeuer := Requeuer{
+		store: store,
+		time:  time2.NewTimeProvider(),
+	}
+
+	r := NewRequeuer(store)
+
+	assert.Equal(t, expRequeuer, r)
+}
+
+func TestRequeuer_Requeue(t *testing.T) {
+	sampleTime := time.Now()
+	timeProvider := &time2.MockProvider{}
+	timeProvider.On("Now").Return(sampleTime)
+	sampleID := uuid.New()
+	defaultStates := []RecordState{Delivered, MaxAttemptsReached, DeadLettered, PendingDeadLetter}
+
+	tests := map[string]struct {
+		requeue  func(r Requeuer) (int64, error)
+		store    func() *MockStore
+		expCount int64
+		expErr   error
+	}{
+		"Requeue by id should requeue the delivered and failed records with the ids": {
+			requeue: func(r Requeuer) (int64, error) {
+				return r.RequeueByID(context.Background(), "admin", sampleID)
+			},
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("RequeueRecords", mock.Anything, RequeueFilter{IDs: []uuid.UUID{sampleID}, States: defaultStates}, "admin", sampleTime.UTC()).
+					Return(int64(1), nil)
+				return &mp
+			},
+			expCount: 1,
+		},
+		"Requeue by topic should requeue the records of the topic": {
+			requeue: func(r Requeuer) (int64, error) {
+				return r.RequeueByTopic(context.Background(), "admin", "testTopic")
+			},
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("RequeueRecords", mock.Anything, RequeueFilter{Topic: "testTopic", States: defaultStates}, "admin", sampleTime.UTC()).
+					Return(int64(3), nil)
+				return &mp
+			},
+			expCount: 3,
+		},
+		"Requeue by time range should requeue the records created within the range": {
+			requeue: func(r Requeuer) (int64, error) {
+				return r.RequeueByTimeRange(context.Background(), "admin", sampleTime.Add(-time.Hour), sampleTime)
+			},
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("RequeueRecords", mock.Anything, RequeueFilter{CreatedFrom: sampleTime.Add(-time.Hour), CreatedTo: sampleTime, States: defaultStates}, "admin", sampleTime.UTC()).
+					Return(int64(2), nil)
+				return &mp
+			},
+			expCount: 2,
+		},
+		"Requeue by error should requeue the records with a matching error": {
+			requeue: func(r Requeuer) (int64, error) {
+				return r.RequeueByError(context.Background(), "admin", "unknown topic")
+			},
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("RequeueRecords", mock.Anything, RequeueFilter{ErrorContains: "unknown topic", States: defaultStates}, "admin", sampleTime.UTC()).
+					Return(int64(5), nil)
+				return &mp
+			},
+			expCount: 5,
+		},
+		"Requeue with explicit states should keep the states": {
+			requeue: func(r Requeuer) (int64, error) {
+				return r.Requeue(context.Background(), "admin", RequeueFilter{Topic: "testTopic", States: []RecordState{MaxAttemptsReached}})
+			},
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("RequeueRecords", mock.Anything, RequeueFilter{Topic: "testTopic", States: []RecordState{MaxAttemptsReached}}, "admin", sampleTime.UTC()).
+					Return(int64(1), nil)
+				return &mp
+			},
+			expCount: 1,
+		},
+		"Requeue without criteria should return an error": {
+			requeue: func(r Requeuer) (int64, error) {
+				return r.Requeue(context.Background(), "admin", RequeueFilter{States: []RecordState{Delivered}})
+			},
+			store: func() *MockStore {
+				return &MockStore{}
+			},
+			expErr: ErrEmptyRequeueFilter,
+		},
+		"Error in store should return an error": {
+			requeue: func(r Requeuer) (int64, error) {
+				return r.RequeueByTopic(context.Background(), "admin", "testTopic")
+			},
+			store: func() *MockStore {
+				mp := MockStore{}
+				mp.On("RequeueRecords", mock.Anything, mock.Anything, "admin", sampleTime.UTC()).
+					Return(int64(0), errors.New("store error"))
+				return &mp
+			},
+			expErr: errors.New("store error"),
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			store := tt.store()
+			r := Requeuer{store: store, time: timeProvider}
+
+			count, err := tt.requeue(r)
+
+			assert.Equal(t, tt.expErr, err)
+			assert.Equal(t, tt.expCount, count)
+			store.AssertExpectations(t)
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package outbox
 
 import (
+	"context"
 	"database/sql"
 	"time"
 
@@ -19,6 +20,12 @@ type Record struct {
 	NumberOfAttempts int
 	LastAttemptOn    *time.Time
 	Error            *string
+	// NextAttemptOn is the earliest time the record is claimed again after a failed attempt
+	NextAttemptOn *time.Time
+	// RequeuedBy identifies who requeued the record the last time
+	RequeuedBy *string
+	// RequeuedOn is the last time the record was requeued
+	RequeuedOn *time.Time
 }
 
 // RecordState is the State of the Record
@@ -31,22 +38,43 @@ const (
 	Delivered
 	// MaxAttemptsReached indicates that the message is not Delivered but the max attempts are reached so it shouldn't be delivered
 	MaxAttemptsReached
+	// DeadLettered indicates that the max attempts are reached and the message was sent to the dead-letter broker
+	DeadLettered
+	// PendingDeadLetter indicates that the max attempts are reached but the message could not be sent to the
+	// dead-letter broker, so the dispatcher sends it again
+	PendingDeadLetter
 )
 
-// Store is the interface that should be implemented by SQL-like database drivers to support the outbox functionality
+// Store is the interface that should be implemented by SQL-like database drivers to support the outbox functionality.
+// The provided context should be used for the underlying database operations
 type Store interface {
 	// AddRecordTx stores the message within the provided database transaction
-	AddRecordTx(record Record, tx *sql.Tx) error
-	// GetRecordsByLockID returns the records by lockID
-	GetRecordsByLockID(lockID string) ([]Record, error)
+	AddRecordTx(ctx context.Context, record Record, tx *sql.Tx) error
+	// GetRecordsByLockID returns the records by lockID ordered by CreatedOn, and in insertion order for records with the
+	// same CreatedOn
+	GetRecordsByLockID(ctx context.Context, lockID string) ([]Record, error)
 	// UpdateRecordLockByState updates the lock of all records with the provided state
-	UpdateRecordLockByState(lockID string, lockedOn time.Time, state RecordState) error
+	//
+	// Deprecated: UpdateRecordLockByState overwrites locks held by other dispatchers. Use ClaimRecordsByState instead.
+	UpdateRecordLockByState(ctx context.Context, lockID string, lockedOn time.Time, state RecordState) error
+	// ClaimRecordsByState atomically locks at most limit unlocked records with the provided state, oldest first.
+	// Records with the same CreatedOn are claimed in insertion order.
+	// Records that are concurrently being claimed by another dispatcher are skipped instead of waited on,
+	// as are records with a NextAttemptOn after lockedOn.
+	ClaimRecordsByState(ctx context.Context, lockID string, lockedOn time.Time, state RecordState, limit int) error
+	// ClaimKeyOrderedRecordsByState claims records like ClaimRecordsByState, but a record with a non-empty Message.Key
+	// is only locked if no older record with the same key and state remains unclaimed by this claim.
+	// A record with the same CreatedOn that was inserted before is older
+	ClaimKeyOrderedRecordsByState(ctx context.Context, lockID string, lockedOn time.Time, state RecordState, limit int) error
 	// UpdateRecordByID updates the provided the record
-	UpdateRecordByID(message Record) error
+	UpdateRecordByID(ctx context.Context, message Record) error
 	// ClearLocksWithDurationBeforeDate clears the locks of records with a lock time before the provided time
-	ClearLocksWithDurationBeforeDate(time time.Time) error
+	ClearLocksWithDurationBeforeDate(ctx context.Context, time time.Time) error
 	// ClearLocksByLockID clears all records locked by the provided lockID
-	ClearLocksByLockID(lockID string) error
+	ClearLocksByLockID(ctx context.Context, lockID string) error
+	// RequeueRecords moves the records that match the filter back to PendingDelivery, resets their attempts, error
+	// and next attempt time, stores requeuedBy and requeuedOn and returns the number of requeued records
+	RequeueRecords(ctx context.Context, filter RequeueFilter, requeuedBy string, requeuedOn time.Time) (int64, error)
 	// RemoveRecordsBeforeDatetime removes all records before the provided time
-	RemoveRecordsBeforeDatetime(expiryTime time.Time) error
+	RemoveRecordsBeforeDatetime(ctx context.Context, expiryTime time.Time) error
 }
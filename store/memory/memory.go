@@ -0,0 +1,251 @@
+// Package memory provides an in-memory implementation of the outbox.Store interface for tests and local development
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// Store implements a thread-safe in-memory Store.
+// It has the locking and state semantics of the sql stores, but it does not take part in database transactions
+type Store struct {
+	mu      sync.Mutex
+	records map[uuid.UUID]outbox.Record
+	// seq is the insertion sequence of the records, which orders the records created at the same time
+	seq     map[uuid.UUID]int64
+	lastSeq int64
+}
+
+// NewStore constructor
+func NewStore() *Store {
+	return &Store{records: make(map[uuid.UUID]outbox.Record), seq: make(map[uuid.UUID]int64)}
+}
+
+// AddRecordTx stores the record. tx is ignored, so the record is visible immediately even if tx is rolled back
+func (s *Store) AddRecordTx(_ context.Context, rec outbox.Record, _ *sql.Tx) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[rec.ID]; !ok {
+		s.lastSeq++
+		s.seq[rec.ID] = s.lastSeq
+	}
+	s.records[rec.ID] = rec
+	return nil
+}
+
+// Records returns all the stored records ordered by CreatedOn and then by insertion order
+func (s *Store) Records() []outbox.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sorted(func(outbox.Record) bool {
+		return true
+	})
+}
+
+// GetRecordsByLockID returns the records of the provided lock id ordered by CreatedOn and then by insertion order
+func (s *Store) GetRecordsByLockID(_ context.Context, lockID string) ([]outbox.Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sorted(func(rec outbox.Record) bool {
+		return rec.LockID != nil && *rec.LockID == lockID
+	}), nil
+}
+
+// UpdateRecordLockByState updates the lock information based on the state
+func (s *Store) UpdateRecordLockByState(_ context.Context, lockID string, lockedOn time.Time, state outbox.RecordState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, rec := range s.records {
+		if rec.State == state {
+			s.lock(id, lockID, lockedOn)
+		}
+	}
+	return nil
+}
+
+// ClaimRecordsByState locks at most limit unlocked records with the provided state, oldest first
+func (s *Store) ClaimRecordsByState(_ context.Context, lockID string, lockedOn time.Time, state outbox.RecordState, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rec := range s.claimCandidates(lockedOn, state, limit) {
+		s.lock(rec.ID, lockID, lockedOn)
+	}
+	return nil
+}
+
+// ClaimKeyOrderedRecordsByState locks at most limit unlocked records with the provided state, skipping records
+// whose key has an older record with the same state that is not part of this claim
+func (s *Store) ClaimKeyOrderedRecordsByState(_ context.Context, lockID string, lockedOn time.Time, state outbox.RecordState, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	candidates := s.claimCandidates(lockedOn, state, limit)
+	claimed := make(map[uuid.UUID]bool, len(candidates))
+	for _, rec := range candidates {
+		claimed[rec.ID] = true
+	}
+	for _, rec := range candidates {
+		if rec.Message.Key == "" || !s.hasOlderUnclaimed(rec, claimed) {
+			s.lock(rec.ID, lockID, lockedOn)
+		}
+	}
+	return nil
+}
+
+// UpdateRecordByID updates the provided record based on its id
+func (s *Store) UpdateRecordByID(_ context.Context, rec outbox.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[rec.ID]; ok {
+		s.records[rec.ID] = rec
+	}
+	return nil
+}
+
+// ClearLocksWithDurationBeforeDate clears the locks of records with a lock time before the provided time
+func (s *Store) ClearLocksWithDurationBeforeDate(_ context.Context, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, rec := range s.records {
+		if rec.LockedOn != nil && rec.LockedOn.Before(t) {
+			s.unlock(id)
+		}
+	}
+	return nil
+}
+
+// ClearLocksByLockID clears lock information of the records with the provided id
+func (s *Store) ClearLocksByLockID(_ context.Context, lockID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, rec := range s.records {
+		if rec.LockID != nil && *rec.LockID == lockID {
+			s.unlock(id)
+		}
+	}
+	return nil
+}
+
+// RequeueRecords moves the records that match the filter back to PendingDelivery
+func (s *Store) RequeueRecords(_ context.Context, filter outbox.RequeueFilter, requeuedBy string, requeuedOn time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for id, rec := range s.records {
+		if !matches(rec, filter) {
+			continue
+		}
+		rec.State = outbox.PendingDelivery
+		rec.NumberOfAttempts = 0
+		rec.Error = nil
+		rec.NextAttemptOn = nil
+		rec.ProcessedOn = nil
+		rec.RequeuedBy = &requeuedBy
+		rec.RequeuedOn = &requeuedOn
+		s.records[id] = rec
+		n++
+	}
+	return n, nil
+}
+
+// RemoveRecordsBeforeDatetime removes records before the provided datetime
+func (s *Store) RemoveRecordsBeforeDatetime(_ context.Context, expiryTime time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, rec := range s.records {
+		if rec.CreatedOn.Before(expiryTime) {
+			delete(s.records, id)
+			delete(s.seq, id)
+		}
+	}
+	return nil
+}
+
+// sorted returns the records that match the predicate ordered by CreatedOn and then by insertion order
+func (s *Store) sorted(predicate func(rec outbox.Record) bool) []outbox.Record {
+	var records []outbox.Record
+	for _, rec := range s.records {
+		if predicate(rec) {
+			records = append(records, rec)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return s.before(records[i], records[j])
+	})
+	return records
+}
+
+// before reports whether rec is ordered before other, by CreatedOn and then by insertion order
+func (s *Store) before(rec outbox.Record, other outbox.Record) bool {
+	if !rec.CreatedOn.Equal(other.CreatedOn) {
+		return rec.CreatedOn.Before(other.CreatedOn)
+	}
+	return s.seq[rec.ID] < s.seq[other.ID]
+}
+
+// claimCandidates returns at most limit unlocked records with the provided state that are due at lockedOn
+func (s *Store) claimCandidates(lockedOn time.Time, state outbox.RecordState, limit int) []outbox.Record {
+	candidates := s.sorted(func(rec outbox.Record) bool {
+		return rec.State == state && rec.LockID == nil && (rec.NextAttemptOn == nil || !rec.NextAttemptOn.After(lockedOn))
+	})
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	return candidates
+}
+
+// hasOlderUnclaimed reports whether an older record with the key and state of rec is not part of the claim
+func (s *Store) hasOlderUnclaimed(rec outbox.Record, claimed map[uuid.UUID]bool) bool {
+	for _, other := range s.records {
+		if other.Message.Key == rec.Message.Key && other.State == rec.State &&
+			s.before(other, rec) && !claimed[other.ID] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) lock(id uuid.UUID, lockID string, lockedOn time.Time) {
+	rec := s.records[id]
+	rec.LockID = &lockID
+	rec.LockedOn = &lockedOn
+	s.records[id] = rec
+}
+
+func (s *Store) unlock(id uuid.UUID) {
+	rec := s.records[id]
+	rec.LockID = nil
+	rec.LockedOn = nil
+	s.records[id] = rec
+}
+
+// matches reports whether the record matches all the set fields of the filter
+func matches(rec outbox.Record, filter outbox.RequeueFilter) bool {
+	if len(filter.IDs) > 0 && !slices.Contains(filter.IDs, rec.ID) {
+		return false
+	}
+	if len(filter.States) > 0 && !slices.Contains(filter.States, rec.State) {
+		return false
+	}
+	if filter.Topic != "" && rec.Message.Topic != filter.Topic {
+		return false
+	}
+	if !filter.CreatedFrom.IsZero() && rec.CreatedOn.Before(filter.CreatedFrom) {
+		return false
+	}
+	if !filter.CreatedTo.IsZero() && !rec.CreatedOn.Before(filter.CreatedTo) {
+		return false
+	}
+	if filter.ErrorContains != "" && (rec.Error == nil || !strings.Contains(*rec.Error, filter.ErrorContains)) {
+		return false
+	}
+	return true
+}
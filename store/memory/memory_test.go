@@ -0,0 +1,218 @@
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkritiotis/outbox"
+	brokermemory "github.com/pkritiotis/outbox/broker/memory"
+	"github.com/pkritiotis/outbox/store/storetest"
+	"github.com/stretchr/testify/assert"
+)
+
+// newRecord returns a pending record of key created at createdOn
+func newRecord(key string, createdOn time.Time) outbox.Record {
+	return outbox.Record{
+		ID:        uuid.New(),
+		Message:   outbox.Message{Key: key, Topic: "topic"},
+		State:     outbox.PendingDelivery,
+		CreatedOn: createdOn,
+	}
+}
+
+func TestStore_Conformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) (outbox.Store, *sql.DB) {
+		return NewStore(), nil
+	})
+}
+
+func TestStore_ClaimRecordsByState(t *testing.T) {
+	now := time.Now().UTC()
+	later := now.Add(time.Minute)
+	otherLock := "other"
+	tests := map[string]struct {
+		records   []outbox.Record
+		limit     int
+		expLocked []int
+	}{
+		"Oldest pending records should be claimed up to the limit": {
+			records: []outbox.Record{
+				newRecord("", now.Add(2*time.Second)),
+				newRecord("", now),
+				newRecord("", now.Add(time.Second)),
+			},
+			limit:     2,
+			expLocked: []int{1, 2},
+		},
+		"Locked, not due and delivered records should not be claimed": {
+			records: func() []outbox.Record {
+				locked := newRecord("", now)
+				locked.LockID = &otherLock
+				locked.LockedOn = &now
+				notDue := newRecord("", now)
+				notDue.NextAttemptOn = &later
+				delivered := newRecord("", now)
+				delivered.State = outbox.Delivered
+				return []outbox.Record{locked, notDue, delivered, newRecord("", now)}
+			}(),
+			limit:     10,
+			expLocked: []int{3},
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			s := NewStore()
+			for _, rec := range tt.records {
+				assert.Nil(t, s.AddRecordTx(context.Background(), rec, nil))
+			}
+
+			err := s.ClaimRecordsByState(context.Background(), "lock", now, outbox.PendingDelivery, tt.limit)
+
+			assert.Nil(t, err)
+			locked, err := s.GetRecordsByLockID(context.Background(), "lock")
+			assert.Nil(t, err)
+			var expIDs, ids []uuid.UUID
+			for _, i := range tt.expLocked {
+				expIDs = append(expIDs, tt.records[i].ID)
+			}
+			for _, rec := range locked {
+				ids = append(ids, rec.ID)
+			}
+			assert.Equal(t, expIDs, ids)
+		})
+	}
+}
+
+func TestStore_ClaimKeyOrderedRecordsByState(t *testing.T) {
+	now := time.Now().UTC()
+	first := newRecord("a", now)
+	second := newRecord("a", now.Add(time.Second))
+	third := newRecord("b", now.Add(2*time.Second))
+	s := NewStore()
+	for _, rec := range []outbox.Record{first, second, third} {
+		assert.Nil(t, s.AddRecordTx(context.Background(), rec, nil))
+	}
+	assert.Nil(t, s.ClaimRecordsByState(context.Background(), "other", now, outbox.PendingDelivery, 1))
+
+	err := s.ClaimKeyOrderedRecordsByState(context.Background(), "lock", now, outbox.PendingDelivery, 10)
+
+	assert.Nil(t, err)
+	locked, err := s.GetRecordsByLockID(context.Background(), "lock")
+	assert.Nil(t, err)
+	assert.Len(t, locked, 1)
+	assert.Equal(t, third.ID, locked[0].ID)
+}
+
+func TestStore_RequeueRecords(t *testing.T) {
+	now := time.Now().UTC()
+	errMsg := "broker unavailable"
+	failed := newRecord("", now)
+	failed.State = outbox.MaxAttemptsReached
+	failed.NumberOfAttempts = 3
+	failed.Error = &errMsg
+	delivered := newRecord("", now)
+	delivered.State = outbox.Delivered
+	s := NewStore()
+	assert.Nil(t, s.AddRecordTx(context.Background(), failed, nil))
+	assert.Nil(t, s.AddRecordTx(context.Background(), delivered, nil))
+
+	n, err := s.RequeueRecords(context.Background(), outbox.RequeueFilter{
+		ErrorContains: "unavailable",
+		States:        []outbox.RecordState{outbox.MaxAttemptsReached},
+	}, "ops", now)
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	records := s.Records()
+	for _, rec := range records {
+		if rec.ID != failed.ID {
+			assert.Equal(t, outbox.Delivered, rec.State)
+			continue
+		}
+		assert.Equal(t, outbox.PendingDelivery, rec.State)
+		assert.Equal(t, 0, rec.NumberOfAttempts)
+		assert.Nil(t, rec.Error)
+		assert.Equal(t, "ops", *rec.RequeuedBy)
+	}
+}
+
+func TestStore_ClearLocksAndRemoveRecords(t *testing.T) {
+	now := time.Now().UTC()
+	old := newRecord("", now.Add(-time.Hour))
+	recent := newRecord("", now)
+	s := NewStore()
+	assert.Nil(t, s.AddRecordTx(context.Background(), old, nil))
+	assert.Nil(t, s.AddRecordTx(context.Background(), recent, nil))
+	assert.Nil(t, s.ClaimRecordsByState(context.Background(), "lock", now.Add(-time.Hour), outbox.PendingDelivery, 10))
+
+	assert.Nil(t, s.ClearLocksWithDurationBeforeDate(context.Background(), now))
+	locked, err := s.GetRecordsByLockID(context.Background(), "lock")
+	assert.Nil(t, err)
+	assert.Empty(t, locked)
+
+	assert.Nil(t, s.RemoveRecordsBeforeDatetime(context.Background(), now.Add(-time.Minute)))
+	records := s.Records()
+	assert.Len(t, records, 1)
+	assert.Equal(t, recent.ID, records[0].ID)
+}
+
+func TestDispatcher_EndToEnd(t *testing.T) {
+	store := NewStore()
+	broker := brokermemory.NewBroker()
+	broker.FailWith(func(msg outbox.Message) error {
+		if msg.Topic == "broken" {
+			return outbox.Permanent(errors.New("rejected"))
+		}
+		return nil
+	})
+	delivered := broker.Subscribe(10)
+	publisher := outbox.NewPublisher(store)
+	assert.Nil(t, publisher.Send(outbox.Message{Key: "a", Topic: "orders", Body: []byte("1")}, nil))
+	assert.Nil(t, publisher.Send(outbox.Message{Key: "a", Topic: "orders", Body: []byte("2")}, nil))
+	assert.Nil(t, publisher.Send(outbox.Message{Key: "b", Topic: "broken", Body: []byte("3")}, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := outbox.NewDispatcher(store, broker, outbox.DispatcherSettings{
+		ProcessInterval:           10 * time.Millisecond,
+		LockCheckerInterval:       time.Minute,
+		MaxLockTimeDuration:       time.Minute,
+		CleanupWorkerInterval:     time.Minute,
+		MessagesRetentionDuration: time.Hour,
+		Ordering:                  outbox.KeyOrderedDelivery,
+	}, "1").Start(ctx)
+
+	for _, body := range []string{"1", "2"} {
+		select {
+		case msg := <-delivered:
+			assert.Equal(t, body, string(msg.Body))
+		case <-time.After(5 * time.Second):
+			t.Fatal("the message was not delivered")
+		}
+	}
+	assert.Eventually(t, func() bool {
+		for _, rec := range store.Records() {
+			if rec.State == outbox.PendingDelivery || rec.LockID != nil {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	h.Wait()
+
+	states := map[string]outbox.RecordState{}
+	for _, rec := range store.Records() {
+		states[string(rec.Message.Body)] = rec.State
+	}
+	assert.Equal(t, map[string]outbox.RecordState{
+		"1": outbox.Delivered,
+		"2": outbox.Delivered,
+		"3": outbox.MaxAttemptsReached,
+	}, states)
+}
@@ -3,10 +3,12 @@ package mysql
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/gob"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql" // needed for loading mysql driver
@@ -39,9 +41,15 @@ func NewStore(settings Settings) (*Store, error) {
 	return &Store{db: db}, nil
 }
 
+// NewStoreFromDB returns a Store that uses the provided db.
+// The connection must be opened with parseTime=True
+func NewStoreFromDB(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
 // ClearLocksWithDurationBeforeDate clears all records with the provided id
-func (s Store) ClearLocksWithDurationBeforeDate(time time.Time) error {
-	_, err := s.db.Exec(
+func (s Store) ClearLocksWithDurationBeforeDate(ctx context.Context, time time.Time) error {
+	_, err := s.db.ExecContext(ctx,
 		`UPDATE outbox 
 		SET
 			locked_by=NULL,
@@ -57,8 +65,8 @@ func (s Store) ClearLocksWithDurationBeforeDate(time time.Time) error {
 }
 
 // UpdateRecordLockByState updated the lock information based on the state
-func (s Store) UpdateRecordLockByState(lockID string, lockedOn time.Time, state outbox.RecordState) error {
-	_, err := s.db.Exec(
+func (s Store) UpdateRecordLockByState(ctx context.Context, lockID string, lockedOn time.Time, state outbox.RecordState) error {
+	_, err := s.db.ExecContext(ctx,
 		`UPDATE outbox 
 		SET 
 			locked_by=?,
@@ -75,8 +83,154 @@ func (s Store) UpdateRecordLockByState(lockID string, lockedOn time.Time, state
 	return nil
 }
 
+// ClaimRecordsByState locks at most limit unlocked records with the provided state.
+// Rows locked by concurrent claims are skipped using SELECT ... FOR UPDATE SKIP LOCKED, which requires MySQL 8.0 or later.
+func (s Store) ClaimRecordsByState(ctx context.Context, lockID string, lockedOn time.Time, state outbox.RecordState, limit int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	candidates, err := selectClaimCandidates(ctx, tx, state, lockedOn, limit)
+	if err != nil {
+		return err
+	}
+	ids := make([]any, 0, len(candidates))
+	for _, c := range candidates {
+		ids = append(ids, c.id)
+	}
+	if err = lockRecords(ctx, tx, lockID, lockedOn, ids); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ClaimKeyOrderedRecordsByState locks at most limit unlocked records with the provided state, skipping records
+// whose key has an older record with the same state that is not part of this claim.
+// Records created at the same time are ordered by the auto increment seq column.
+// The older records are checked after the candidates are locked, so a concurrent claim of an older record
+// always blocks the newer records of its key.
+func (s Store) ClaimKeyOrderedRecordsByState(ctx context.Context, lockID string, lockedOn time.Time, state outbox.RecordState, limit int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	candidates, err := selectClaimCandidates(ctx, tx, state, lockedOn, limit)
+	if err != nil {
+		return err
+	}
+	var candidateIDs []any
+	keyed := false
+	for _, c := range candidates {
+		candidateIDs = append(candidateIDs, c.id)
+		keyed = keyed || c.key != ""
+	}
+
+	blocked := make(map[string]bool)
+	if keyed {
+		params := "?" + strings.Repeat(",?", len(candidateIDs)-1)
+		rows, queryErr := tx.QueryContext(ctx,
+			`SELECT c.id FROM outbox c
+			WHERE c.id IN (`+params+`) AND c.message_key <> '' AND EXISTS (
+				SELECT 1 FROM outbox o
+				WHERE o.message_key = c.message_key
+				AND o.state = c.state
+				AND (o.created_on < c.created_on OR (o.created_on = c.created_on AND o.seq < c.seq))
+				AND o.id NOT IN (`+params+`)
+			)
+			`,
+			append(append([]any{}, candidateIDs...), candidateIDs...)...,
+		)
+		if queryErr != nil {
+			return queryErr
+		}
+		for rows.Next() {
+			var id string
+			if scanErr := rows.Scan(&id); scanErr != nil {
+				rows.Close()
+				return scanErr
+			}
+			blocked[id] = true
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	var ids []any
+	for _, c := range candidates {
+		if !blocked[c.id] {
+			ids = append(ids, c.id)
+		}
+	}
+	if err = lockRecords(ctx, tx, lockID, lockedOn, ids); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// claimCandidate is an unlocked record that is selected for claiming
+type claimCandidate struct {
+	id  string
+	key string
+}
+
+// selectClaimCandidates locks at most limit unlocked records with the provided state that are due at lockedOn within tx,
+// oldest first and in insertion order for records created at the same time
+func selectClaimCandidates(ctx context.Context, tx *sql.Tx, state outbox.RecordState, lockedOn time.Time, limit int) ([]claimCandidate, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id, message_key FROM outbox
+		WHERE state = ? AND locked_by IS NULL AND (next_attempt_on IS NULL OR next_attempt_on <= ?)
+		ORDER BY created_on, seq
+		LIMIT ?
+		FOR UPDATE SKIP LOCKED
+		`,
+		state,
+		lockedOn,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []claimCandidate
+	for rows.Next() {
+		var c claimCandidate
+		if scanErr := rows.Scan(&c.id, &c.key); scanErr != nil {
+			return nil, scanErr
+		}
+		candidates = append(candidates, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
+
+// lockRecords sets the lock information of the records with the provided ids within tx
+func lockRecords(ctx context.Context, tx *sql.Tx, lockID string, lockedOn time.Time, ids []any) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := append([]any{lockID, lockedOn}, ids...)
+	_, err := tx.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			locked_by=?,
+			locked_on=?
+		WHERE id IN (?`+strings.Repeat(",?", len(ids)-1)+`)`,
+		args...,
+	)
+	return err
+}
+
 // UpdateRecordByID updates the provided record based on its id
-func (s Store) UpdateRecordByID(rec outbox.Record) error {
+func (s Store) UpdateRecordByID(ctx context.Context, rec outbox.Record) error {
 	msgData := new(bytes.Buffer)
 	enc := gob.NewEncoder(msgData)
 	encErr := enc.Encode(rec.Message)
@@ -84,10 +238,12 @@ func (s Store) UpdateRecordByID(rec outbox.Record) error {
 		return encErr
 	}
 
-	_, err := s.db.Exec(
+	_, err := s.db.ExecContext(ctx,
 		`UPDATE outbox 
 		SET 
 			data=?,
+			message_key=?,
+			topic=?,
 			state=?,
 			created_on=?,
 			locked_by=?,
@@ -95,10 +251,15 @@ func (s Store) UpdateRecordByID(rec outbox.Record) error {
 			processed_on=?,
 		    number_of_attempts=?,
 		    last_attempted_on=?,
-		    error=?
+		    error=?,
+		    next_attempt_on=?,
+		    requeued_by=?,
+		    requeued_on=?
 		WHERE id = ?
 		`,
 		msgData.Bytes(),
+		rec.Message.Key,
+		rec.Message.Topic,
 		rec.State,
 		rec.CreatedOn,
 		rec.LockID,
@@ -107,6 +268,9 @@ func (s Store) UpdateRecordByID(rec outbox.Record) error {
 		rec.NumberOfAttempts,
 		rec.LastAttemptOn,
 		rec.Error,
+		rec.NextAttemptOn,
+		rec.RequeuedBy,
+		rec.RequeuedOn,
 		rec.ID,
 	)
 	if err != nil {
@@ -116,13 +280,13 @@ func (s Store) UpdateRecordByID(rec outbox.Record) error {
 }
 
 // ClearLocksByLockID clears lock information of the records with the provided id
-func (s Store) ClearLocksByLockID(lockID string) error {
-	_, err := s.db.Exec(
+func (s Store) ClearLocksByLockID(ctx context.Context, lockID string) error {
+	_, err := s.db.ExecContext(ctx,
 		`UPDATE outbox 
 		SET 
 			locked_by=NULL,
 			locked_on=NULL
-		WHERE id = ?
+		WHERE locked_by = ?
 		`,
 		lockID)
 	if err != nil {
@@ -132,9 +296,9 @@ func (s Store) ClearLocksByLockID(lockID string) error {
 }
 
 // GetRecordsByLockID returns the records of the provided id
-func (s Store) GetRecordsByLockID(lockID string) ([]outbox.Record, error) {
-	rows, err := s.db.Query(
-		"SELECT id, data, state, created_on,locked_by,locked_on,processed_on,number_of_attempts,last_attempted_on,error from outbox WHERE locked_by = ?",
+func (s Store) GetRecordsByLockID(ctx context.Context, lockID string) ([]outbox.Record, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, data, state, created_on,locked_by,locked_on,processed_on,number_of_attempts,last_attempted_on,error,next_attempt_on,requeued_by,requeued_on from outbox WHERE locked_by = ? ORDER BY created_on, seq",
 		lockID,
 	)
 	if err != nil {
@@ -149,7 +313,7 @@ func (s Store) GetRecordsByLockID(lockID string) ([]outbox.Record, error) {
 	for rows.Next() {
 		var rec outbox.Record
 		var data []byte
-		scanErr := rows.Scan(&rec.ID, &data, &rec.State, &rec.CreatedOn, &rec.LockID, &rec.LockedOn, &rec.ProcessedOn, &rec.NumberOfAttempts, &rec.LastAttemptOn, &rec.Error)
+		scanErr := rows.Scan(&rec.ID, &data, &rec.State, &rec.CreatedOn, &rec.LockID, &rec.LockedOn, &rec.ProcessedOn, &rec.NumberOfAttempts, &rec.LastAttemptOn, &rec.Error, &rec.NextAttemptOn, &rec.RequeuedBy, &rec.RequeuedOn)
 		if scanErr != nil {
 			if scanErr == sql.ErrNoRows {
 				return messages, nil
@@ -170,7 +334,7 @@ func (s Store) GetRecordsByLockID(lockID string) ([]outbox.Record, error) {
 }
 
 // AddRecordTx stores the record in the db within the provided transaction tx
-func (s Store) AddRecordTx(rec outbox.Record, tx *sql.Tx) error {
+func (s Store) AddRecordTx(ctx context.Context, rec outbox.Record, tx *sql.Tx) error {
 	msgBuf := new(bytes.Buffer)
 	msgEnc := gob.NewEncoder(msgBuf)
 	encErr := msgEnc.Encode(rec.Message)
@@ -178,11 +342,13 @@ func (s Store) AddRecordTx(rec outbox.Record, tx *sql.Tx) error {
 	if encErr != nil {
 		return encErr
 	}
-	q := "INSERT INTO outbox (id, data, state, created_on,locked_by,locked_on,processed_on,number_of_attempts,last_attempted_on,error) VALUES (?,?,?,?,?,?,?,?,?,?)"
+	q := "INSERT INTO outbox (id, data, message_key, topic, state, created_on,locked_by,locked_on,processed_on,number_of_attempts,last_attempted_on,error,next_attempt_on,requeued_by,requeued_on) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)"
 
-	_, err := tx.Exec(q,
+	_, err := tx.ExecContext(ctx, q,
 		rec.ID,
 		msgBuf.Bytes(),
+		rec.Message.Key,
+		rec.Message.Topic,
 		rec.State,
 		rec.CreatedOn,
 		rec.LockID,
@@ -190,16 +356,77 @@ func (s Store) AddRecordTx(rec outbox.Record, tx *sql.Tx) error {
 		rec.ProcessedOn,
 		rec.NumberOfAttempts,
 		rec.LastAttemptOn,
-		rec.Error)
+		rec.Error,
+		rec.NextAttemptOn,
+		rec.RequeuedBy,
+		rec.RequeuedOn)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// RequeueRecords moves the records that match the filter back to PendingDelivery
+func (s Store) RequeueRecords(ctx context.Context, filter outbox.RequeueFilter, requeuedBy string, requeuedOn time.Time) (int64, error) {
+	conditions, conditionArgs := requeueConditions(filter)
+	args := append([]any{outbox.PendingDelivery, requeuedBy, requeuedOn}, conditionArgs...)
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			state=?,
+			number_of_attempts=0,
+			error=NULL,
+			next_attempt_on=NULL,
+			processed_on=NULL,
+			requeued_by=?,
+			requeued_on=?
+		WHERE `+conditions,
+		args...,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// requeueConditions returns the WHERE clause conditions and arguments that select the records of the filter
+func requeueConditions(filter outbox.RequeueFilter) (string, []any) {
+	conditions := []string{"TRUE"}
+	var args []any
+	if len(filter.IDs) > 0 {
+		conditions = append(conditions, "id IN (?"+strings.Repeat(",?", len(filter.IDs)-1)+")")
+		for _, id := range filter.IDs {
+			args = append(args, id)
+		}
+	}
+	if len(filter.States) > 0 {
+		conditions = append(conditions, "state IN (?"+strings.Repeat(",?", len(filter.States)-1)+")")
+		for _, state := range filter.States {
+			args = append(args, state)
+		}
+	}
+	if filter.Topic != "" {
+		conditions = append(conditions, "topic = ?")
+		args = append(args, filter.Topic)
+	}
+	if !filter.CreatedFrom.IsZero() {
+		conditions = append(conditions, "created_on >= ?")
+		args = append(args, filter.CreatedFrom)
+	}
+	if !filter.CreatedTo.IsZero() {
+		conditions = append(conditions, "created_on < ?")
+		args = append(args, filter.CreatedTo)
+	}
+	if filter.ErrorContains != "" {
+		conditions = append(conditions, "LOCATE(?, error) > 0")
+		args = append(args, filter.ErrorContains)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
 // RemoveRecordsBeforeDatetime removes records before the provided datetime
-func (s Store) RemoveRecordsBeforeDatetime(expiryTime time.Time) error {
-	_, err := s.db.Exec(
+func (s Store) RemoveRecordsBeforeDatetime(ctx context.Context, expiryTime time.Time) error {
+	_, err := s.db.ExecContext(ctx,
 		`DELETE FROM outbox 
 		WHERE created_on < ?
 		`,
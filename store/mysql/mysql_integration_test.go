@@ -0,0 +1,34 @@
+//go:build integration
+
+package mysql
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/pkritiotis/outbox"
+	"github.com/pkritiotis/outbox/store/storetest"
+)
+
+// TestStore_Conformance runs against the database of OUTBOX_MYSQL_DSN, e.g. root:a123456@tcp(localhost:3306)/outbox?parseTime=True,
+// which must have the outbox table. The records of the table are deleted
+func TestStore_Conformance(t *testing.T) {
+	dsn := os.Getenv("OUTBOX_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("OUTBOX_MYSQL_DSN is not set")
+	}
+	storetest.RunConformance(t, func(t *testing.T) (outbox.Store, *sql.DB) {
+		db, err := sql.Open("mysql", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+		if _, err = db.Exec("DELETE FROM outbox"); err != nil {
+			t.Fatal(err)
+		}
+		return NewStoreFromDB(db), db
+	})
+}
@@ -0,0 +1,126 @@
+package mysql
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_ClaimRecordsByState(t *testing.T) {
+	lockedOn := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	sampleErr := errors.New("failed")
+	tests := map[string]struct {
+		expect func(mock sqlmock.Sqlmock)
+		expErr error
+	}{
+		"Candidates should be selected with SKIP LOCKED and locked": {
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(regexp.QuoteMeta(`ORDER BY created_on, seq
+		LIMIT ?
+		FOR UPDATE SKIP LOCKED`)).
+					WithArgs(outbox.PendingDelivery, lockedOn, 10).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "message_key"}).
+						AddRow("first", "").
+						AddRow("second", ""))
+				mock.ExpectExec(regexp.QuoteMeta(`WHERE id IN (?,?)`)).
+					WithArgs("lock", lockedOn, "first", "second").
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectCommit()
+			},
+		},
+		"No candidates should not lock any records": {
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(regexp.QuoteMeta(`FOR UPDATE SKIP LOCKED`)).
+					WithArgs(outbox.PendingDelivery, lockedOn, 10).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "message_key"}))
+				mock.ExpectCommit()
+			},
+		},
+		"Select error should roll back the claim": {
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(regexp.QuoteMeta(`FOR UPDATE SKIP LOCKED`)).
+					WithArgs(outbox.PendingDelivery, lockedOn, 10).
+					WillReturnError(sampleErr)
+				mock.ExpectRollback()
+			},
+			expErr: sampleErr,
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(t, err)
+			defer db.Close()
+			tt.expect(mock)
+
+			err = NewStoreFromDB(db).ClaimRecordsByState(context.Background(), "lock", lockedOn, outbox.PendingDelivery, 10)
+
+			assert.Equal(t, tt.expErr, err)
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestStore_ClaimKeyOrderedRecordsByState(t *testing.T) {
+	lockedOn := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := map[string]struct {
+		expect func(mock sqlmock.Sqlmock)
+	}{
+		"Candidates with an older unclaimed record of their key should not be locked": {
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(regexp.QuoteMeta(`FOR UPDATE SKIP LOCKED`)).
+					WithArgs(outbox.PendingDelivery, lockedOn, 10).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "message_key"}).
+						AddRow("first", "sampleKey").
+						AddRow("second", "otherKey").
+						AddRow("third", ""))
+				mock.ExpectQuery(regexp.QuoteMeta(`(o.created_on < c.created_on OR (o.created_on = c.created_on AND o.seq < c.seq))`)).
+					WithArgs("first", "second", "third", "first", "second", "third").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("second"))
+				mock.ExpectExec(regexp.QuoteMeta(`WHERE id IN (?,?)`)).
+					WithArgs("lock", lockedOn, "first", "third").
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectCommit()
+			},
+		},
+		"Candidates without a key should be locked without checking older records": {
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(regexp.QuoteMeta(`FOR UPDATE SKIP LOCKED`)).
+					WithArgs(outbox.PendingDelivery, lockedOn, 10).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "message_key"}).
+						AddRow("first", ""))
+				mock.ExpectExec(regexp.QuoteMeta(`WHERE id IN (?)`)).
+					WithArgs("lock", lockedOn, "first").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(t, err)
+			defer db.Close()
+			tt.expect(mock)
+
+			err = NewStoreFromDB(db).ClaimKeyOrderedRecordsByState(context.Background(), "lock", lockedOn, outbox.PendingDelivery, 10)
+
+			assert.Nil(t, err)
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,369 @@
+// Package postgres provides a postgres implementation of the outbox.Store interface
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq" // needed for loading postgres driver
+	"github.com/pkritiotis/outbox"
+)
+
+// Settings contain the postgres settings
+type Settings struct {
+	PostgresUsername string
+	PostgresPass     string
+	PostgresHost     string
+	PostgresPort     string
+	PostgresDB       string
+	// PostgresSSLMode is passed as the sslmode connection parameter. The driver default is used when empty.
+	PostgresSSLMode string
+}
+
+// Store implements a postgres Store
+type Store struct {
+	db *sql.DB
+}
+
+// NewStore constructor
+func NewStore(settings Settings) (*Store, error) {
+	db, err := sql.Open("postgres", connectionString(settings))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	if err = db.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// NewStoreFromDB returns a Store that uses the provided db
+func NewStoreFromDB(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+func connectionString(settings Settings) string {
+	u := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(settings.PostgresUsername, settings.PostgresPass),
+		Host:   fmt.Sprintf("%v:%v", settings.PostgresHost, settings.PostgresPort),
+		Path:   settings.PostgresDB,
+	}
+	if settings.PostgresSSLMode != "" {
+		u.RawQuery = url.Values{"sslmode": []string{settings.PostgresSSLMode}}.Encode()
+	}
+	return u.String()
+}
+
+// ClearLocksWithDurationBeforeDate clears the locks of records with a lock time before the provided time
+func (s Store) ClearLocksWithDurationBeforeDate(ctx context.Context, time time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			locked_by=NULL,
+			locked_on=NULL
+		WHERE locked_on < $1
+		`,
+		time,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateRecordLockByState updated the lock information based on the state
+func (s Store) UpdateRecordLockByState(ctx context.Context, lockID string, lockedOn time.Time, state outbox.RecordState) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			locked_by=$1,
+			locked_on=$2
+		WHERE state = $3
+		`,
+		lockID,
+		lockedOn,
+		state,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ClaimRecordsByState locks at most limit unlocked records with the provided state.
+// Rows locked by concurrent claims are skipped using SELECT ... FOR UPDATE SKIP LOCKED.
+func (s Store) ClaimRecordsByState(ctx context.Context, lockID string, lockedOn time.Time, state outbox.RecordState, limit int) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			locked_by=$1,
+			locked_on=$2
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE state = $3 AND locked_by IS NULL AND (next_attempt_on IS NULL OR next_attempt_on <= $2)
+			ORDER BY created_on, seq
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		`,
+		lockID,
+		lockedOn,
+		state,
+		limit,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ClaimKeyOrderedRecordsByState locks at most limit unlocked records with the provided state, skipping records
+// whose key has an older record with the same state that is not part of this claim.
+// Records created at the same time are ordered by the identity seq column.
+// A concurrently claimed older record is still in the provided state, so it always blocks the newer records of its key.
+func (s Store) ClaimKeyOrderedRecordsByState(ctx context.Context, lockID string, lockedOn time.Time, state outbox.RecordState, limit int) error {
+	_, err := s.db.ExecContext(ctx,
+		`WITH candidates AS (
+			SELECT id, message_key, created_on, seq FROM outbox
+			WHERE state = $3 AND locked_by IS NULL AND (next_attempt_on IS NULL OR next_attempt_on <= $2)
+			ORDER BY created_on, seq
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE outbox
+		SET
+			locked_by=$1,
+			locked_on=$2
+		WHERE id IN (
+			SELECT c.id FROM candidates c
+			WHERE c.message_key = '' OR NOT EXISTS (
+				SELECT 1 FROM outbox o
+				WHERE o.message_key = c.message_key
+				AND o.state = $3
+				AND (o.created_on < c.created_on OR (o.created_on = c.created_on AND o.seq < c.seq))
+				AND o.id NOT IN (SELECT id FROM candidates)
+			)
+		)
+		`,
+		lockID,
+		lockedOn,
+		state,
+		limit,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateRecordByID updates the provided record based on its id
+func (s Store) UpdateRecordByID(ctx context.Context, rec outbox.Record) error {
+	msgData := new(bytes.Buffer)
+	enc := gob.NewEncoder(msgData)
+	encErr := enc.Encode(rec.Message)
+	if encErr != nil {
+		return encErr
+	}
+
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			data=$1,
+			message_key=$2,
+			topic=$3,
+			state=$4,
+			created_on=$5,
+			locked_by=$6,
+			locked_on=$7,
+			processed_on=$8,
+			number_of_attempts=$9,
+			last_attempted_on=$10,
+			error=$11,
+			next_attempt_on=$12,
+			requeued_by=$13,
+			requeued_on=$14
+		WHERE id = $15
+		`,
+		msgData.Bytes(),
+		rec.Message.Key,
+		rec.Message.Topic,
+		rec.State,
+		rec.CreatedOn,
+		rec.LockID,
+		rec.LockedOn,
+		rec.ProcessedOn,
+		rec.NumberOfAttempts,
+		rec.LastAttemptOn,
+		rec.Error,
+		rec.NextAttemptOn,
+		rec.RequeuedBy,
+		rec.RequeuedOn,
+		rec.ID,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ClearLocksByLockID clears lock information of the records with the provided id
+func (s Store) ClearLocksByLockID(ctx context.Context, lockID string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			locked_by=NULL,
+			locked_on=NULL
+		WHERE locked_by = $1
+		`,
+		lockID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetRecordsByLockID returns the records of the provided id
+func (s Store) GetRecordsByLockID(ctx context.Context, lockID string) ([]outbox.Record, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, data, state, created_on, locked_by, locked_on, processed_on, number_of_attempts, last_attempted_on, error, next_attempt_on, requeued_by, requeued_on FROM outbox WHERE locked_by = $1 ORDER BY created_on, seq",
+		lockID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []outbox.Record
+
+	for rows.Next() {
+		var rec outbox.Record
+		var data []byte
+		scanErr := rows.Scan(&rec.ID, &data, &rec.State, &rec.CreatedOn, &rec.LockID, &rec.LockedOn, &rec.ProcessedOn, &rec.NumberOfAttempts, &rec.LastAttemptOn, &rec.Error, &rec.NextAttemptOn, &rec.RequeuedBy, &rec.RequeuedOn)
+		if scanErr != nil {
+			return messages, scanErr
+		}
+		decErr := gob.NewDecoder(bytes.NewReader(data)).Decode(&rec.Message)
+		if decErr != nil {
+			return nil, decErr
+		}
+
+		messages = append(messages, rec)
+	}
+	if err = rows.Err(); err != nil {
+		return messages, err
+	}
+	return messages, nil
+}
+
+// AddRecordTx stores the record in the db within the provided transaction tx
+func (s Store) AddRecordTx(ctx context.Context, rec outbox.Record, tx *sql.Tx) error {
+	msgBuf := new(bytes.Buffer)
+	msgEnc := gob.NewEncoder(msgBuf)
+	encErr := msgEnc.Encode(rec.Message)
+
+	if encErr != nil {
+		return encErr
+	}
+	q := "INSERT INTO outbox (id, data, message_key, topic, state, created_on, locked_by, locked_on, processed_on, number_of_attempts, last_attempted_on, error, next_attempt_on, requeued_by, requeued_on) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15)"
+
+	_, err := tx.ExecContext(ctx, q,
+		rec.ID,
+		msgBuf.Bytes(),
+		rec.Message.Key,
+		rec.Message.Topic,
+		rec.State,
+		rec.CreatedOn,
+		rec.LockID,
+		rec.LockedOn,
+		rec.ProcessedOn,
+		rec.NumberOfAttempts,
+		rec.LastAttemptOn,
+		rec.Error,
+		rec.NextAttemptOn,
+		rec.RequeuedBy,
+		rec.RequeuedOn)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RequeueRecords moves the records that match the filter back to PendingDelivery
+func (s Store) RequeueRecords(ctx context.Context, filter outbox.RequeueFilter, requeuedBy string, requeuedOn time.Time) (int64, error) {
+	args := []any{outbox.PendingDelivery, requeuedBy, requeuedOn}
+	conditions := requeueConditions(filter, &args)
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			state=$1,
+			number_of_attempts=0,
+			error=NULL,
+			next_attempt_on=NULL,
+			processed_on=NULL,
+			requeued_by=$2,
+			requeued_on=$3
+		WHERE `+conditions,
+		args...,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// requeueConditions returns the WHERE clause conditions that select the records of the filter and appends their
+// arguments to args
+func requeueConditions(filter outbox.RequeueFilter, args *[]any) string {
+	param := func(v any) string {
+		*args = append(*args, v)
+		return fmt.Sprintf("$%d", len(*args))
+	}
+	conditions := []string{"TRUE"}
+	if len(filter.IDs) > 0 {
+		params := make([]string, len(filter.IDs))
+		for i, id := range filter.IDs {
+			params[i] = param(id)
+		}
+		conditions = append(conditions, "id IN ("+strings.Join(params, ",")+")")
+	}
+	if len(filter.States) > 0 {
+		params := make([]string, len(filter.States))
+		for i, state := range filter.States {
+			params[i] = param(state)
+		}
+		conditions = append(conditions, "state IN ("+strings.Join(params, ",")+")")
+	}
+	if filter.Topic != "" {
+		conditions = append(conditions, "topic = "+param(filter.Topic))
+	}
+	if !filter.CreatedFrom.IsZero() {
+		conditions = append(conditions, "created_on >= "+param(filter.CreatedFrom))
+	}
+	if !filter.CreatedTo.IsZero() {
+		conditions = append(conditions, "created_on < "+param(filter.CreatedTo))
+	}
+	if filter.ErrorContains != "" {
+		conditions = append(conditions, "strpos(error, "+param(filter.ErrorContains)+") > 0")
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// RemoveRecordsBeforeDatetime removes records before the provided datetime
+func (s Store) RemoveRecordsBeforeDatetime(ctx context.Context, expiryTime time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		`DELETE FROM outbox
+		WHERE created_on < $1
+		`,
+		expiryTime)
+	if err != nil {
+		return err
+	}
+	return nil
+}
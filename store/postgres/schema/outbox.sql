@@ -0,0 +1,25 @@
+CREATE TABLE outbox (
+        id uuid NOT NULL PRIMARY KEY,
+        data bytea NOT NULL,
+        message_key text NOT NULL DEFAULT '',
+        topic text NOT NULL DEFAULT '',
+        state INT NOT NULL,
+        created_on timestamptz NOT NULL,
+        locked_by varchar(100) NULL,
+        locked_on timestamptz NULL,
+        processed_on timestamptz NULL,
+        number_of_attempts INT NOT NULL,
+        last_attempted_on timestamptz NULL,
+        error text NULL,
+        next_attempt_on timestamptz NULL,
+        requeued_by varchar(100) NULL,
+        requeued_on timestamptz NULL,
+        seq bigint GENERATED ALWAYS AS IDENTITY UNIQUE
+);
+
+CREATE INDEX outbox_claim_idx ON outbox (state, locked_by, created_on, seq);
+CREATE INDEX outbox_locked_by_idx ON outbox (locked_by);
+CREATE INDEX outbox_locked_on_idx ON outbox (locked_on);
+CREATE INDEX outbox_created_on_idx ON outbox (created_on);
+CREATE INDEX outbox_message_key_idx ON outbox (message_key, state, created_on, seq);
+CREATE INDEX outbox_topic_idx ON outbox (topic, state);
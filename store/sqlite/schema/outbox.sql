@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS outbox (
+        id TEXT NOT NULL PRIMARY KEY,
+        data BLOB NOT NULL,
+        message_key TEXT NOT NULL DEFAULT '',
+        topic TEXT NOT NULL DEFAULT '',
+        state INTEGER NOT NULL,
+        created_on DATETIME NOT NULL,
+        locked_by TEXT NULL,
+        locked_on DATETIME NULL,
+        processed_on DATETIME NULL,
+        number_of_attempts INTEGER NOT NULL,
+        last_attempted_on DATETIME NULL,
+        error TEXT NULL,
+        next_attempt_on DATETIME NULL,
+        requeued_by TEXT NULL,
+        requeued_on DATETIME NULL,
+        seq INTEGER NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS outbox_seq_idx ON outbox (seq);
+CREATE INDEX IF NOT EXISTS outbox_claim_idx ON outbox (state, locked_by, created_on, seq);
+CREATE INDEX IF NOT EXISTS outbox_locked_by_idx ON outbox (locked_by);
+CREATE INDEX IF NOT EXISTS outbox_locked_on_idx ON outbox (locked_on);
+CREATE INDEX IF NOT EXISTS outbox_created_on_idx ON outbox (created_on);
+CREATE INDEX IF NOT EXISTS outbox_message_key_idx ON outbox (message_key, state, created_on, seq);
+CREATE INDEX IF NOT EXISTS outbox_topic_idx ON outbox (topic, state);
@@ -0,0 +1,497 @@
+// Package sqlite provides a sqlite implementation of the outbox.Store interface
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	_ "embed" // needed for embedding the schema
+	"encoding/gob"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // needed for loading sqlite driver
+	"github.com/pkritiotis/outbox"
+)
+
+// Schema is the DDL of the outbox table and its indexes
+//
+//go:embed schema/outbox.sql
+var Schema string
+
+// timeLayout is the layout of the stored times. Times are stored as fixed-width UTC text so that they compare in order
+const timeLayout = "2006-01-02 15:04:05.000000000-07:00"
+
+// Settings contain the sqlite settings
+type Settings struct {
+	// Path is the path of the database file
+	Path string
+	// BusyTimeout is how long a connection waits for the write lock of another connection. Defaults to 5 seconds
+	BusyTimeout time.Duration
+}
+
+// Store implements a sqlite Store.
+// SQLite has a single writer, so records are claimed within immediate transactions that take the write lock up front
+type Store struct {
+	db *sql.DB
+}
+
+// NewStore opens the database with Open and creates the outbox table if it does not exist
+func NewStore(settings Settings) (*Store, error) {
+	db, err := Open(settings)
+	if err != nil {
+		return nil, err
+	}
+	s := NewStoreFromDB(db)
+	if err = s.CreateSchema(context.Background()); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create schema: %w", err)
+	}
+	return s, nil
+}
+
+// Open opens the database in WAL mode, so that readers do not block the writer, with the busy timeout of the settings.
+// Transactions of the returned db begin immediately, so a transaction passed to Publisher.Send takes the write lock
+// when it begins instead of failing with SQLITE_BUSY when it first writes.
+// Use the returned db for the transactions of Publisher.Send and NewStoreFromDB for the Store
+func Open(settings Settings) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", connectionString(settings))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err = db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	return db, nil
+}
+
+// NewStoreFromDB returns a Store that uses the provided db. It does not create the outbox table.
+// The db should use WAL mode and a busy timeout, as the db returned by Open does
+func NewStoreFromDB(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+func connectionString(settings Settings) string {
+	busyTimeout := settings.BusyTimeout
+	if busyTimeout == 0 {
+		busyTimeout = 5 * time.Second
+	}
+	params := url.Values{
+		"_journal_mode": []string{"WAL"},
+		"_busy_timeout": []string{fmt.Sprint(busyTimeout.Milliseconds())},
+		"_txlock":       []string{"immediate"},
+	}
+	return "file:" + settings.Path + "?" + params.Encode()
+}
+
+// CreateSchema creates the outbox table and its indexes if they do not exist
+func (s Store) CreateSchema(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, Schema)
+	return err
+}
+
+// ClearLocksWithDurationBeforeDate clears the locks of records with a lock time before the provided time
+func (s Store) ClearLocksWithDurationBeforeDate(ctx context.Context, time time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			locked_by=NULL,
+			locked_on=NULL
+		WHERE locked_on < ?
+		`,
+		timeArg(time),
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateRecordLockByState updates the lock information based on the state
+func (s Store) UpdateRecordLockByState(ctx context.Context, lockID string, lockedOn time.Time, state outbox.RecordState) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			locked_by=?,
+			locked_on=?
+		WHERE state = ?
+		`,
+		lockID,
+		timeArg(lockedOn),
+		state,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ClaimRecordsByState locks at most limit unlocked records with the provided state.
+// The records are selected and locked within an immediate transaction, so concurrent claims are serialized
+func (s Store) ClaimRecordsByState(ctx context.Context, lockID string, lockedOn time.Time, state outbox.RecordState, limit int) error {
+	return s.immediate(ctx, func(conn *sql.Conn) error {
+		candidates, err := selectClaimCandidates(ctx, conn, state, lockedOn, limit)
+		if err != nil {
+			return err
+		}
+		ids := make([]any, 0, len(candidates))
+		for _, c := range candidates {
+			ids = append(ids, c.id)
+		}
+		return lockRecords(ctx, conn, lockID, lockedOn, ids)
+	})
+}
+
+// ClaimKeyOrderedRecordsByState locks at most limit unlocked records with the provided state, skipping records
+// whose key has an older record with the same state that is not part of this claim.
+// Records created at the same time are ordered by the seq column.
+// The records are selected and locked within an immediate transaction, so concurrent claims are serialized
+func (s Store) ClaimKeyOrderedRecordsByState(ctx context.Context, lockID string, lockedOn time.Time, state outbox.RecordState, limit int) error {
+	return s.immediate(ctx, func(conn *sql.Conn) error {
+		candidates, err := selectClaimCandidates(ctx, conn, state, lockedOn, limit)
+		if err != nil {
+			return err
+		}
+		var candidateIDs []any
+		keyed := false
+		for _, c := range candidates {
+			candidateIDs = append(candidateIDs, c.id)
+			keyed = keyed || c.key != ""
+		}
+
+		blocked := make(map[string]bool)
+		if keyed {
+			params := "?" + strings.Repeat(",?", len(candidateIDs)-1)
+			rows, queryErr := conn.QueryContext(ctx,
+				`SELECT c.id FROM outbox c
+				WHERE c.id IN (`+params+`) AND c.message_key <> '' AND EXISTS (
+					SELECT 1 FROM outbox o
+					WHERE o.message_key = c.message_key
+					AND o.state = c.state
+					AND (o.created_on < c.created_on OR (o.created_on = c.created_on AND o.seq < c.seq))
+					AND o.id NOT IN (`+params+`)
+				)
+				`,
+				append(append([]any{}, candidateIDs...), candidateIDs...)...,
+			)
+			if queryErr != nil {
+				return queryErr
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var id string
+				if scanErr := rows.Scan(&id); scanErr != nil {
+					return scanErr
+				}
+				blocked[id] = true
+			}
+			if err = rows.Err(); err != nil {
+				return err
+			}
+		}
+
+		var ids []any
+		for _, c := range candidates {
+			if !blocked[c.id] {
+				ids = append(ids, c.id)
+			}
+		}
+		return lockRecords(ctx, conn, lockID, lockedOn, ids)
+	})
+}
+
+// immediate runs fn within an immediate transaction of a single connection.
+// An immediate transaction takes the write lock when it begins, so the selected records cannot change before they are locked
+func (s Store) immediate(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return err
+	}
+	if err = fn(conn); err == nil {
+		_, err = conn.ExecContext(ctx, "COMMIT")
+	}
+	if err != nil {
+		_, _ = conn.ExecContext(context.Background(), "ROLLBACK")
+		return err
+	}
+	return nil
+}
+
+// claimCandidate is an unlocked record that is selected for claiming
+type claimCandidate struct {
+	id  string
+	key string
+}
+
+// selectClaimCandidates returns at most limit unlocked records with the provided state that are due at lockedOn,
+// oldest first and in insertion order for records created at the same time
+func selectClaimCandidates(ctx context.Context, conn *sql.Conn, state outbox.RecordState, lockedOn time.Time, limit int) ([]claimCandidate, error) {
+	rows, err := conn.QueryContext(ctx,
+		`SELECT id, message_key FROM outbox
+		WHERE state = ? AND locked_by IS NULL AND (next_attempt_on IS NULL OR next_attempt_on <= ?)
+		ORDER BY created_on, seq
+		LIMIT ?
+		`,
+		state,
+		timeArg(lockedOn),
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []claimCandidate
+	for rows.Next() {
+		var c claimCandidate
+		if scanErr := rows.Scan(&c.id, &c.key); scanErr != nil {
+			return nil, scanErr
+		}
+		candidates = append(candidates, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
+
+// lockRecords sets the lock information of the records with the provided ids
+func lockRecords(ctx context.Context, conn *sql.Conn, lockID string, lockedOn time.Time, ids []any) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := append([]any{lockID, timeArg(lockedOn)}, ids...)
+	_, err := conn.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			locked_by=?,
+			locked_on=?
+		WHERE id IN (?`+strings.Repeat(",?", len(ids)-1)+`)`,
+		args...,
+	)
+	return err
+}
+
+// UpdateRecordByID updates the provided record based on its id
+func (s Store) UpdateRecordByID(ctx context.Context, rec outbox.Record) error {
+	msgData := new(bytes.Buffer)
+	enc := gob.NewEncoder(msgData)
+	encErr := enc.Encode(rec.Message)
+	if encErr != nil {
+		return encErr
+	}
+
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			data=?,
+			message_key=?,
+			topic=?,
+			state=?,
+			created_on=?,
+			locked_by=?,
+			locked_on=?,
+			processed_on=?,
+			number_of_attempts=?,
+			last_attempted_on=?,
+			error=?,
+			next_attempt_on=?,
+			requeued_by=?,
+			requeued_on=?
+		WHERE id = ?
+		`,
+		msgData.Bytes(),
+		rec.Message.Key,
+		rec.Message.Topic,
+		rec.State,
+		timeArg(rec.CreatedOn),
+		rec.LockID,
+		nullTimeArg(rec.LockedOn),
+		nullTimeArg(rec.ProcessedOn),
+		rec.NumberOfAttempts,
+		nullTimeArg(rec.LastAttemptOn),
+		rec.Error,
+		nullTimeArg(rec.NextAttemptOn),
+		rec.RequeuedBy,
+		nullTimeArg(rec.RequeuedOn),
+		rec.ID,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ClearLocksByLockID clears lock information of the records with the provided id
+func (s Store) ClearLocksByLockID(ctx context.Context, lockID string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			locked_by=NULL,
+			locked_on=NULL
+		WHERE locked_by = ?
+		`,
+		lockID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetRecordsByLockID returns the records of the provided id
+func (s Store) GetRecordsByLockID(ctx context.Context, lockID string) ([]outbox.Record, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, data, state, created_on,locked_by,locked_on,processed_on,number_of_attempts,last_attempted_on,error,next_attempt_on,requeued_by,requeued_on from outbox WHERE locked_by = ? ORDER BY created_on, seq",
+		lockID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []outbox.Record
+	for rows.Next() {
+		var rec outbox.Record
+		var data []byte
+		scanErr := rows.Scan(&rec.ID, &data, &rec.State, &rec.CreatedOn, &rec.LockID, &rec.LockedOn, &rec.ProcessedOn, &rec.NumberOfAttempts, &rec.LastAttemptOn, &rec.Error, &rec.NextAttemptOn, &rec.RequeuedBy, &rec.RequeuedOn)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		decErr := gob.NewDecoder(bytes.NewReader(data)).Decode(&rec.Message)
+		if decErr != nil {
+			return nil, decErr
+		}
+		messages = append(messages, rec)
+	}
+	if err = rows.Err(); err != nil {
+		return messages, err
+	}
+	return messages, nil
+}
+
+// AddRecordTx stores the record in the db within the provided transaction tx
+func (s Store) AddRecordTx(ctx context.Context, rec outbox.Record, tx *sql.Tx) error {
+	msgBuf := new(bytes.Buffer)
+	msgEnc := gob.NewEncoder(msgBuf)
+	encErr := msgEnc.Encode(rec.Message)
+
+	if encErr != nil {
+		return encErr
+	}
+	// seq orders the records created at the same time in insertion order. SQLite has a single writer, so the
+	// records of concurrent transactions cannot get the same seq
+	q := "INSERT INTO outbox (id, data, message_key, topic, state, created_on,locked_by,locked_on,processed_on,number_of_attempts,last_attempted_on,error,next_attempt_on,requeued_by,requeued_on,seq) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,(SELECT IFNULL(MAX(seq), 0) + 1 FROM outbox))"
+
+	_, err := tx.ExecContext(ctx, q,
+		rec.ID,
+		msgBuf.Bytes(),
+		rec.Message.Key,
+		rec.Message.Topic,
+		rec.State,
+		timeArg(rec.CreatedOn),
+		rec.LockID,
+		nullTimeArg(rec.LockedOn),
+		nullTimeArg(rec.ProcessedOn),
+		rec.NumberOfAttempts,
+		nullTimeArg(rec.LastAttemptOn),
+		rec.Error,
+		nullTimeArg(rec.NextAttemptOn),
+		rec.RequeuedBy,
+		nullTimeArg(rec.RequeuedOn))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RequeueRecords moves the records that match the filter back to PendingDelivery
+func (s Store) RequeueRecords(ctx context.Context, filter outbox.RequeueFilter, requeuedBy string, requeuedOn time.Time) (int64, error) {
+	conditions, conditionArgs := requeueConditions(filter)
+	args := append([]any{outbox.PendingDelivery, requeuedBy, timeArg(requeuedOn)}, conditionArgs...)
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			state=?,
+			number_of_attempts=0,
+			error=NULL,
+			next_attempt_on=NULL,
+			processed_on=NULL,
+			requeued_by=?,
+			requeued_on=?
+		WHERE `+conditions,
+		args...,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// requeueConditions returns the WHERE clause conditions and arguments that select the records of the filter
+func requeueConditions(filter outbox.RequeueFilter) (string, []any) {
+	conditions := []string{"TRUE"}
+	var args []any
+	if len(filter.IDs) > 0 {
+		conditions = append(conditions, "id IN (?"+strings.Repeat(",?", len(filter.IDs)-1)+")")
+		for _, id := range filter.IDs {
+			args = append(args, id)
+		}
+	}
+	if len(filter.States) > 0 {
+		conditions = append(conditions, "state IN (?"+strings.Repeat(",?", len(filter.States)-1)+")")
+		for _, state := range filter.States {
+			args = append(args, state)
+		}
+	}
+	if filter.Topic != "" {
+		conditions = append(conditions, "topic = ?")
+		args = append(args, filter.Topic)
+	}
+	if !filter.CreatedFrom.IsZero() {
+		conditions = append(conditions, "created_on >= ?")
+		args = append(args, timeArg(filter.CreatedFrom))
+	}
+	if !filter.CreatedTo.IsZero() {
+		conditions = append(conditions, "created_on < ?")
+		args = append(args, timeArg(filter.CreatedTo))
+	}
+	if filter.ErrorContains != "" {
+		conditions = append(conditions, "instr(error, ?) > 0")
+		args = append(args, filter.ErrorContains)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// RemoveRecordsBeforeDatetime removes records before the provided datetime
+func (s Store) RemoveRecordsBeforeDatetime(ctx context.Context, expiryTime time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		`DELETE FROM outbox
+		WHERE created_on < ?
+		`,
+		timeArg(expiryTime))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// timeArg returns the stored text of t
+func timeArg(t time.Time) string {
+	return t.UTC().Format(timeLayout)
+}
+
+// nullTimeArg returns the stored text of t, or nil when t is nil
+func nullTimeArg(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return timeArg(*t)
+}
@@ -0,0 +1,44 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkritiotis/outbox"
+	"github.com/pkritiotis/outbox/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newDB opens a new database file of the test with the outbox table
+func newDB(t *testing.T) (*Store, *sql.DB) {
+	db, err := Open(Settings{Path: filepath.Join(t.TempDir(), "outbox.db")})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	s := NewStoreFromDB(db)
+	require.NoError(t, s.CreateSchema(context.Background()))
+	return s, db
+}
+
+func TestStore_Conformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) (outbox.Store, *sql.DB) {
+		return newDB(t)
+	})
+}
+
+func TestNewStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.db")
+
+	s, err := NewStore(Settings{Path: path})
+	require.NoError(t, err)
+	_, err = NewStore(Settings{Path: path})
+	require.NoError(t, err, "the schema should be created only if it does not exist")
+
+	var journalMode string
+	require.NoError(t, s.db.QueryRow("PRAGMA journal_mode").Scan(&journalMode))
+	assert.Equal(t, "wal", journalMode)
+}
@@ -0,0 +1,25 @@
+CREATE TABLE outbox (
+        id uniqueidentifier NOT NULL PRIMARY KEY,
+        data varbinary(max) NOT NULL,
+        message_key nvarchar(255) NOT NULL DEFAULT '',
+        topic nvarchar(255) NOT NULL DEFAULT '',
+        state INT NOT NULL,
+        created_on datetime2 NOT NULL,
+        locked_by nvarchar(100) NULL,
+        locked_on datetime2 NULL,
+        processed_on datetime2 NULL,
+        number_of_attempts INT NOT NULL,
+        last_attempted_on datetime2 NULL,
+        error nvarchar(max) NULL,
+        next_attempt_on datetime2 NULL,
+        requeued_by nvarchar(100) NULL,
+        requeued_on datetime2 NULL,
+        seq bigint IDENTITY(1,1) NOT NULL UNIQUE
+);
+
+CREATE INDEX outbox_claim_idx ON outbox (state, locked_by, created_on, seq);
+CREATE INDEX outbox_locked_by_idx ON outbox (locked_by);
+CREATE INDEX outbox_locked_on_idx ON outbox (locked_on);
+CREATE INDEX outbox_created_on_idx ON outbox (created_on);
+CREATE INDEX outbox_message_key_idx ON outbox (message_key, state, created_on, seq);
+CREATE INDEX outbox_topic_idx ON outbox (topic, state);
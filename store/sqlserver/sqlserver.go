@@ -0,0 +1,466 @@
+// Package sqlserver provides a Microsoft SQL Server implementation of the outbox.Store interface
+package sqlserver
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-sql/civil"
+	"github.com/google/uuid"
+	mssql "github.com/microsoft/go-mssqldb" // also loads the sqlserver driver
+	"github.com/pkritiotis/outbox"
+)
+
+// Settings contain the sqlserver settings
+type Settings struct {
+	SQLServerUsername string
+	SQLServerPass     string
+	SQLServerHost     string
+	SQLServerPort     string
+	SQLServerDB       string
+}
+
+// Store implements a sqlserver Store
+type Store struct {
+	db *sql.DB
+}
+
+// NewStore constructor
+func NewStore(settings Settings) (*Store, error) {
+	db, err := sql.Open("sqlserver", connectionString(settings))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	if err = db.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// NewStoreFromDB returns a Store that uses the provided db
+func NewStoreFromDB(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+func connectionString(settings Settings) string {
+	u := url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(settings.SQLServerUsername, settings.SQLServerPass),
+		Host:     fmt.Sprintf("%v:%v", settings.SQLServerHost, settings.SQLServerPort),
+		RawQuery: url.Values{"database": []string{settings.SQLServerDB}}.Encode(),
+	}
+	return u.String()
+}
+
+// ClearLocksWithDurationBeforeDate clears the locks of records with a lock time before the provided time
+func (s Store) ClearLocksWithDurationBeforeDate(ctx context.Context, time time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			locked_by=NULL,
+			locked_on=NULL
+		WHERE locked_on < @p1
+		`,
+		timeArg(time),
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateRecordLockByState updates the lock information based on the state
+func (s Store) UpdateRecordLockByState(ctx context.Context, lockID string, lockedOn time.Time, state outbox.RecordState) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			locked_by=@p1,
+			locked_on=@p2
+		WHERE state = @p3
+		`,
+		lockID,
+		timeArg(lockedOn),
+		state,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ClaimRecordsByState locks at most limit unlocked records with the provided state.
+// Rows locked by concurrent claims are skipped using the UPDLOCK and READPAST table hints.
+func (s Store) ClaimRecordsByState(ctx context.Context, lockID string, lockedOn time.Time, state outbox.RecordState, limit int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	candidates, err := selectClaimCandidates(ctx, tx, state, lockedOn, limit)
+	if err != nil {
+		return err
+	}
+	ids := make([]any, 0, len(candidates))
+	for _, c := range candidates {
+		ids = append(ids, c.id)
+	}
+	if err = lockRecords(ctx, tx, lockID, lockedOn, ids); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ClaimKeyOrderedRecordsByState locks at most limit unlocked records with the provided state, skipping records
+// whose key has an older record with the same state that is not part of this claim.
+// Records created at the same time are ordered by the identity seq column.
+// The older records are checked after the candidates are locked, so a concurrent claim of an older record
+// always blocks the newer records of its key.
+func (s Store) ClaimKeyOrderedRecordsByState(ctx context.Context, lockID string, lockedOn time.Time, state outbox.RecordState, limit int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	candidates, err := selectClaimCandidates(ctx, tx, state, lockedOn, limit)
+	if err != nil {
+		return err
+	}
+	var candidateIDs []any
+	keyed := false
+	for _, c := range candidates {
+		candidateIDs = append(candidateIDs, c.id)
+		keyed = keyed || c.key != ""
+	}
+
+	blocked := make(map[mssql.UniqueIdentifier]bool)
+	if keyed {
+		var args []any
+		rows, queryErr := tx.QueryContext(ctx,
+			`SELECT c.id FROM outbox c
+			WHERE c.id IN (`+params(&args, candidateIDs)+`) AND c.message_key <> '' AND EXISTS (
+				SELECT 1 FROM outbox o
+				WHERE o.message_key = c.message_key
+				AND o.state = c.state
+				AND (o.created_on < c.created_on OR (o.created_on = c.created_on AND o.seq < c.seq))
+				AND o.id NOT IN (`+params(&args, candidateIDs)+`)
+			)
+			`,
+			args...,
+		)
+		if queryErr != nil {
+			return queryErr
+		}
+		for rows.Next() {
+			var id mssql.UniqueIdentifier
+			if scanErr := rows.Scan(&id); scanErr != nil {
+				rows.Close()
+				return scanErr
+			}
+			blocked[id] = true
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	var ids []any
+	for _, c := range candidates {
+		if !blocked[c.id] {
+			ids = append(ids, c.id)
+		}
+	}
+	if err = lockRecords(ctx, tx, lockID, lockedOn, ids); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// claimCandidate is an unlocked record that is selected for claiming
+type claimCandidate struct {
+	id  mssql.UniqueIdentifier
+	key string
+}
+
+// selectClaimCandidates locks at most limit unlocked records with the provided state that are due at lockedOn within tx, oldest first
+// and in insertion order for records created at the same time.
+// UPDLOCK keeps the rows locked until tx ends and READPAST skips the rows locked by concurrent claims
+func selectClaimCandidates(ctx context.Context, tx *sql.Tx, state outbox.RecordState, lockedOn time.Time, limit int) ([]claimCandidate, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT TOP (@p1) id, message_key FROM outbox WITH (UPDLOCK, READPAST, ROWLOCK)
+		WHERE state = @p2 AND locked_by IS NULL AND (next_attempt_on IS NULL OR next_attempt_on <= @p3)
+		ORDER BY created_on, seq
+		`,
+		limit,
+		state,
+		timeArg(lockedOn),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []claimCandidate
+	for rows.Next() {
+		var c claimCandidate
+		if scanErr := rows.Scan(&c.id, &c.key); scanErr != nil {
+			return nil, scanErr
+		}
+		candidates = append(candidates, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
+
+// lockRecords sets the lock information of the records with the provided ids within tx
+func lockRecords(ctx context.Context, tx *sql.Tx, lockID string, lockedOn time.Time, ids []any) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := []any{lockID, timeArg(lockedOn)}
+	_, err := tx.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			locked_by=@p1,
+			locked_on=@p2
+		WHERE id IN (`+params(&args, ids)+`)`,
+		args...,
+	)
+	return err
+}
+
+// UpdateRecordByID updates the provided record based on its id
+func (s Store) UpdateRecordByID(ctx context.Context, rec outbox.Record) error {
+	msgData := new(bytes.Buffer)
+	enc := gob.NewEncoder(msgData)
+	encErr := enc.Encode(rec.Message)
+	if encErr != nil {
+		return encErr
+	}
+
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			data=@p1,
+			message_key=@p2,
+			topic=@p3,
+			state=@p4,
+			created_on=@p5,
+			locked_by=@p6,
+			locked_on=@p7,
+			processed_on=@p8,
+			number_of_attempts=@p9,
+			last_attempted_on=@p10,
+			error=@p11,
+			next_attempt_on=@p12,
+			requeued_by=@p13,
+			requeued_on=@p14
+		WHERE id = @p15
+		`,
+		msgData.Bytes(),
+		rec.Message.Key,
+		rec.Message.Topic,
+		rec.State,
+		timeArg(rec.CreatedOn),
+		rec.LockID,
+		nullTimeArg(rec.LockedOn),
+		nullTimeArg(rec.ProcessedOn),
+		rec.NumberOfAttempts,
+		nullTimeArg(rec.LastAttemptOn),
+		rec.Error,
+		nullTimeArg(rec.NextAttemptOn),
+		rec.RequeuedBy,
+		nullTimeArg(rec.RequeuedOn),
+		mssql.UniqueIdentifier(rec.ID),
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ClearLocksByLockID clears lock information of the records with the provided id
+func (s Store) ClearLocksByLockID(ctx context.Context, lockID string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			locked_by=NULL,
+			locked_on=NULL
+		WHERE locked_by = @p1
+		`,
+		lockID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetRecordsByLockID returns the records of the provided id
+func (s Store) GetRecordsByLockID(ctx context.Context, lockID string) ([]outbox.Record, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, data, state, created_on, locked_by, locked_on, processed_on, number_of_attempts, last_attempted_on, error, next_attempt_on, requeued_by, requeued_on FROM outbox WHERE locked_by = @p1 ORDER BY created_on, seq",
+		lockID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []outbox.Record
+
+	for rows.Next() {
+		var rec outbox.Record
+		var id mssql.UniqueIdentifier
+		var data []byte
+		scanErr := rows.Scan(&id, &data, &rec.State, &rec.CreatedOn, &rec.LockID, &rec.LockedOn, &rec.ProcessedOn, &rec.NumberOfAttempts, &rec.LastAttemptOn, &rec.Error, &rec.NextAttemptOn, &rec.RequeuedBy, &rec.RequeuedOn)
+		if scanErr != nil {
+			return messages, scanErr
+		}
+		rec.ID = uuid.UUID(id)
+		decErr := gob.NewDecoder(bytes.NewReader(data)).Decode(&rec.Message)
+		if decErr != nil {
+			return nil, decErr
+		}
+
+		messages = append(messages, rec)
+	}
+	if err = rows.Err(); err != nil {
+		return messages, err
+	}
+	return messages, nil
+}
+
+// AddRecordTx stores the record in the db within the provided transaction tx
+func (s Store) AddRecordTx(ctx context.Context, rec outbox.Record, tx *sql.Tx) error {
+	msgBuf := new(bytes.Buffer)
+	msgEnc := gob.NewEncoder(msgBuf)
+	encErr := msgEnc.Encode(rec.Message)
+
+	if encErr != nil {
+		return encErr
+	}
+	q := `INSERT INTO outbox (id, data, message_key, topic, state, created_on, locked_by, locked_on, processed_on, number_of_attempts, last_attempted_on, error, next_attempt_on, requeued_by, requeued_on)
+	VALUES (@p1, @p2, @p3, @p4, @p5, @p6, @p7, @p8, @p9, @p10, @p11, @p12, @p13, @p14, @p15)`
+
+	_, err := tx.ExecContext(ctx, q,
+		mssql.UniqueIdentifier(rec.ID),
+		msgBuf.Bytes(),
+		rec.Message.Key,
+		rec.Message.Topic,
+		rec.State,
+		timeArg(rec.CreatedOn),
+		rec.LockID,
+		nullTimeArg(rec.LockedOn),
+		nullTimeArg(rec.ProcessedOn),
+		rec.NumberOfAttempts,
+		nullTimeArg(rec.LastAttemptOn),
+		rec.Error,
+		nullTimeArg(rec.NextAttemptOn),
+		rec.RequeuedBy,
+		nullTimeArg(rec.RequeuedOn))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RequeueRecords moves the records that match the filter back to PendingDelivery
+func (s Store) RequeueRecords(ctx context.Context, filter outbox.RequeueFilter, requeuedBy string, requeuedOn time.Time) (int64, error) {
+	args := []any{outbox.PendingDelivery, requeuedBy, timeArg(requeuedOn)}
+	conditions := requeueConditions(filter, &args)
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE outbox
+		SET
+			state=@p1,
+			number_of_attempts=0,
+			error=NULL,
+			next_attempt_on=NULL,
+			processed_on=NULL,
+			requeued_by=@p2,
+			requeued_on=@p3
+		WHERE `+conditions,
+		args...,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// requeueConditions returns the WHERE clause conditions that select the records of the filter and appends their arguments to args
+func requeueConditions(filter outbox.RequeueFilter, args *[]any) string {
+	conditions := []string{"1 = 1"}
+	if len(filter.IDs) > 0 {
+		ids := make([]any, len(filter.IDs))
+		for i, id := range filter.IDs {
+			ids[i] = mssql.UniqueIdentifier(id)
+		}
+		conditions = append(conditions, "id IN ("+params(args, ids)+")")
+	}
+	if len(filter.States) > 0 {
+		states := make([]any, len(filter.States))
+		for i, state := range filter.States {
+			states[i] = state
+		}
+		conditions = append(conditions, "state IN ("+params(args, states)+")")
+	}
+	if filter.Topic != "" {
+		conditions = append(conditions, "topic = "+params(args, []any{filter.Topic}))
+	}
+	if !filter.CreatedFrom.IsZero() {
+		conditions = append(conditions, "created_on >= "+params(args, []any{timeArg(filter.CreatedFrom)}))
+	}
+	if !filter.CreatedTo.IsZero() {
+		conditions = append(conditions, "created_on < "+params(args, []any{timeArg(filter.CreatedTo)}))
+	}
+	if filter.ErrorContains != "" {
+		conditions = append(conditions, "CHARINDEX("+params(args, []any{filter.ErrorContains})+", error) > 0")
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// RemoveRecordsBeforeDatetime removes records before the provided datetime
+func (s Store) RemoveRecordsBeforeDatetime(ctx context.Context, expiryTime time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		`DELETE FROM outbox
+		WHERE created_on < @p1
+		`,
+		timeArg(expiryTime))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// params appends values to args and returns their comma separated @p parameters
+func params(args *[]any, values []any) string {
+	names := make([]string, len(values))
+	for i, v := range values {
+		*args = append(*args, v)
+		names[i] = fmt.Sprintf("@p%d", len(*args))
+	}
+	return strings.Join(names, ",")
+}
+
+// timeArg returns t as a datetime2 argument in UTC
+func timeArg(t time.Time) civil.DateTime {
+	return civil.DateTimeOf(t.UTC())
+}
+
+// nullTimeArg returns t as a datetime2 argument in UTC, or nil when t is nil
+func nullTimeArg(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return timeArg(*t)
+}
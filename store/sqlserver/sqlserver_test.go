@@ -0,0 +1,124 @@
+package sqlserver
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-sql/civil"
+	"github.com/google/uuid"
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/pkritiotis/outbox"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// valueConverter passes the datetime2 arguments to sqlmock as they are, like the sqlserver driver does
+type valueConverter struct{}
+
+func (valueConverter) ConvertValue(v any) (driver.Value, error) {
+	if t, ok := v.(civil.DateTime); ok {
+		return t, nil
+	}
+	return driver.DefaultParameterConverter.ConvertValue(v)
+}
+
+func TestStore_ClaimRecordsByState(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(valueConverter{}))
+	require.NoError(t, err)
+	defer db.Close()
+	lockedOn := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	first, second := mssql.UniqueIdentifier(uuid.New()), mssql.UniqueIdentifier(uuid.New())
+	firstValue, _ := first.Value()
+	secondValue, _ := second.Value()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT TOP (@p1) id, message_key FROM outbox WITH (UPDLOCK, READPAST, ROWLOCK)`)).
+		WithArgs(10, outbox.PendingDelivery, civil.DateTimeOf(lockedOn)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "message_key"}).
+			AddRow(firstValue, "").
+			AddRow(secondValue, ""))
+	mock.ExpectExec(regexp.QuoteMeta(`WHERE id IN (@p3,@p4)`)).
+		WithArgs("lock", civil.DateTimeOf(lockedOn), firstValue, secondValue).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	err = NewStoreFromDB(db).ClaimRecordsByState(context.Background(), "lock", lockedOn, outbox.PendingDelivery, 10)
+
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestStore_ClaimKeyOrderedRecordsByState(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(valueConverter{}))
+	require.NoError(t, err)
+	defer db.Close()
+	lockedOn := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	first, second := mssql.UniqueIdentifier(uuid.New()), mssql.UniqueIdentifier(uuid.New())
+	firstValue, _ := first.Value()
+	secondValue, _ := second.Value()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT TOP (@p1) id, message_key FROM outbox WITH (UPDLOCK, READPAST, ROWLOCK)`)).
+		WithArgs(10, outbox.PendingDelivery, civil.DateTimeOf(lockedOn)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "message_key"}).
+			AddRow(firstValue, "sampleKey").
+			AddRow(secondValue, "otherKey"))
+	mock.ExpectQuery(regexp.QuoteMeta(`AND o.id NOT IN (@p3,@p4)`)).
+		WithArgs(firstValue, secondValue, firstValue, secondValue).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(secondValue))
+	mock.ExpectExec(regexp.QuoteMeta(`WHERE id IN (@p3)`)).
+		WithArgs("lock", civil.DateTimeOf(lockedOn), firstValue).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = NewStoreFromDB(db).ClaimKeyOrderedRecordsByState(context.Background(), "lock", lockedOn, outbox.PendingDelivery, 10)
+
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRequeueConditions(t *testing.T) {
+	id := uuid.New()
+	from := time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("", 3600))
+	tests := map[string]struct {
+		filter        outbox.RequeueFilter
+		expConditions string
+		expArgs       []any
+	}{
+		"Empty filter should select all the records": {
+			expConditions: "1 = 1",
+			expArgs:       []any{},
+		},
+		"Filter fields should be numbered after the existing arguments": {
+			filter: outbox.RequeueFilter{
+				IDs:           []uuid.UUID{id},
+				States:        []outbox.RecordState{outbox.MaxAttemptsReached, outbox.DeadLettered},
+				Topic:         "orders",
+				CreatedFrom:   from,
+				ErrorContains: "timeout",
+			},
+			expConditions: "1 = 1 AND id IN (@p2) AND state IN (@p3,@p4) AND topic = @p5 AND created_on >= @p6 AND CHARINDEX(@p7, error) > 0",
+			expArgs: []any{
+				mssql.UniqueIdentifier(id),
+				outbox.MaxAttemptsReached,
+				outbox.DeadLettered,
+				"orders",
+				civil.DateTimeOf(from.UTC()),
+				"timeout",
+			},
+		},
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			args := []any{outbox.PendingDelivery}
+
+			conditions := requeueConditions(tt.filter, &args)
+
+			assert.Equal(t, tt.expConditions, conditions)
+			assert.Equal(t, tt.expArgs, args[1:])
+		})
+	}
+}
@@ -0,0 +1,353 @@
+// Package storetest provides a conformance test suite for outbox.Store implementations
+package storetest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pkritiotis/outbox"
+)
+
+// Factory returns a new Store without any records and the db whose transactions are passed to its AddRecordTx.
+// db is nil for stores that do not take part in sql transactions, which skips the transaction tests
+type Factory func(t *testing.T) (store outbox.Store, db *sql.DB)
+
+// RunConformance runs the conformance test suite against the stores returned by factory.
+// Every test calls factory for a new store
+func RunConformance(t *testing.T, factory Factory) {
+	tests := map[string]func(t *testing.T, factory Factory){
+		"TxVisibility":       testTxVisibility,
+		"TxRollback":         testTxRollback,
+		"LockExclusivity":    testLockExclusivity,
+		"NotDueRecords":      testNotDueRecords,
+		"KeyOrderedClaim":    testKeyOrderedClaim,
+		"KeyOrderedTies":     testKeyOrderedTies,
+		"LockExpiry":         testLockExpiry,
+		"StateTransitions":   testStateTransitions,
+		"Requeue":            testRequeue,
+		"Retention":          testRetention,
+		"ConcurrentClaimers": testConcurrentClaimers,
+	}
+	for name, test := range tests {
+		tt := test
+		t.Run(name, func(t *testing.T) {
+			tt(t, factory)
+		})
+	}
+}
+
+// now returns the current time truncated to the precision that all the stores keep
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+// newRecord returns a pending record of key created at createdOn
+func newRecord(key string, createdOn time.Time) outbox.Record {
+	return outbox.Record{
+		ID: uuid.New(),
+		Message: outbox.Message{
+			Key:     key,
+			Headers: map[string]string{"header": "value"},
+			Body:    []byte("body"),
+			Topic:   "topic",
+		},
+		State:     outbox.PendingDelivery,
+		CreatedOn: createdOn,
+	}
+}
+
+// addRecords adds the records to the store outside any transaction of the test
+func addRecords(t *testing.T, store outbox.Store, db *sql.DB, records ...outbox.Record) {
+	for _, rec := range records {
+		var tx *sql.Tx
+		if db != nil {
+			var err error
+			tx, err = db.Begin()
+			require.NoError(t, err)
+		}
+		require.NoError(t, store.AddRecordTx(context.Background(), rec, tx))
+		if tx != nil {
+			require.NoError(t, tx.Commit())
+		}
+	}
+}
+
+// claim claims at most limit records with state for lockID and returns their ids in CreatedOn order
+func claim(t *testing.T, store outbox.Store, lockID string, lockedOn time.Time, state outbox.RecordState, limit int) []uuid.UUID {
+	require.NoError(t, store.ClaimRecordsByState(context.Background(), lockID, lockedOn, state, limit))
+	return lockedIDs(t, store, lockID)
+}
+
+// lockedIDs returns the ids of the records locked by lockID in CreatedOn order
+func lockedIDs(t *testing.T, store outbox.Store, lockID string) []uuid.UUID {
+	records, err := store.GetRecordsByLockID(context.Background(), lockID)
+	require.NoError(t, err)
+	var ids []uuid.UUID
+	for _, rec := range records {
+		ids = append(ids, rec.ID)
+	}
+	return ids
+}
+
+func ids(records ...outbox.Record) []uuid.UUID {
+	var ids []uuid.UUID
+	for _, rec := range records {
+		ids = append(ids, rec.ID)
+	}
+	return ids
+}
+
+func testTxVisibility(t *testing.T, factory Factory) {
+	store, db := factory(t)
+	if db == nil {
+		t.Skip("the store does not take part in sql transactions")
+	}
+	rec := newRecord("", now())
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	require.NoError(t, store.AddRecordTx(context.Background(), rec, tx))
+	require.NoError(t, tx.Commit())
+
+	assert.Equal(t, ids(rec), claim(t, store, "lock", now(), outbox.PendingDelivery, 10))
+}
+
+func testTxRollback(t *testing.T, factory Factory) {
+	store, db := factory(t)
+	if db == nil {
+		t.Skip("the store does not take part in sql transactions")
+	}
+	rec := newRecord("", now())
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	require.NoError(t, store.AddRecordTx(context.Background(), rec, tx))
+	require.NoError(t, tx.Rollback())
+
+	assert.Empty(t, claim(t, store, "lock", now(), outbox.PendingDelivery, 10))
+}
+
+func testLockExclusivity(t *testing.T, factory Factory) {
+	store, db := factory(t)
+	createdOn := now().Add(-time.Minute)
+	var records []outbox.Record
+	for i := 0; i < 5; i++ {
+		records = append(records, newRecord("", createdOn.Add(time.Duration(i)*time.Second)))
+	}
+	addRecords(t, store, db, records[4], records[2], records[0], records[3], records[1])
+
+	first := claim(t, store, "first", now(), outbox.PendingDelivery, 3)
+	second := claim(t, store, "second", now(), outbox.PendingDelivery, 10)
+	third := claim(t, store, "third", now(), outbox.PendingDelivery, 10)
+
+	assert.Equal(t, ids(records[:3]...), first, "the oldest records should be claimed up to the limit")
+	assert.Equal(t, ids(records[3:]...), second, "locked records should not be claimed again")
+	assert.Empty(t, third)
+}
+
+func testNotDueRecords(t *testing.T, factory Factory) {
+	store, db := factory(t)
+	later := now().Add(time.Hour)
+	due := newRecord("", now().Add(-time.Minute))
+	notDue := newRecord("", now().Add(-time.Minute))
+	notDue.NextAttemptOn = &later
+	addRecords(t, store, db, due, notDue)
+
+	assert.Equal(t, ids(due), claim(t, store, "lock", now(), outbox.PendingDelivery, 10))
+	assert.Equal(t, ids(notDue), claim(t, store, "later", later, outbox.PendingDelivery, 10))
+}
+
+func testKeyOrderedClaim(t *testing.T, factory Factory) {
+	store, db := factory(t)
+	createdOn := now().Add(-time.Minute)
+	first := newRecord("a", createdOn)
+	second := newRecord("a", createdOn.Add(time.Second))
+	other := newRecord("b", createdOn.Add(2*time.Second))
+	addRecords(t, store, db, first, second, other)
+	assert.Equal(t, ids(first), claim(t, store, "first", now(), outbox.PendingDelivery, 1))
+
+	require.NoError(t, store.ClaimKeyOrderedRecordsByState(context.Background(), "second", now(), outbox.PendingDelivery, 10))
+
+	assert.Equal(t, ids(other), lockedIDs(t, store, "second"),
+		"records should not be claimed while an older record of their key is locked by another claim")
+}
+
+func testKeyOrderedTies(t *testing.T, factory Factory) {
+	store, db := factory(t)
+	createdOn := now().Add(-time.Minute)
+	first := newRecord("a", createdOn)
+	second := newRecord("a", createdOn)
+	addRecords(t, store, db, first, second)
+
+	require.NoError(t, store.ClaimKeyOrderedRecordsByState(context.Background(), "first", now(), outbox.PendingDelivery, 1))
+	require.NoError(t, store.ClaimKeyOrderedRecordsByState(context.Background(), "second", now(), outbox.PendingDelivery, 10))
+
+	assert.Equal(t, ids(first), lockedIDs(t, store, "first"),
+		"records created at the same time should be claimed in insertion order")
+	assert.Empty(t, lockedIDs(t, store, "second"),
+		"a record should not be claimed while a record of its key that was created at the same time and inserted before it is locked by another claim")
+}
+
+func testLockExpiry(t *testing.T, factory Factory) {
+	store, db := factory(t)
+	expired := newRecord("", now().Add(-2*time.Hour))
+	active := newRecord("", now().Add(-time.Hour))
+	released := newRecord("", now().Add(-time.Minute))
+	addRecords(t, store, db, expired, active, released)
+	claim(t, store, "expired", now().Add(-time.Hour), outbox.PendingDelivery, 1)
+	claim(t, store, "active", now(), outbox.PendingDelivery, 1)
+	claim(t, store, "released", now(), outbox.PendingDelivery, 1)
+
+	require.NoError(t, store.ClearLocksWithDurationBeforeDate(context.Background(), now().Add(-time.Minute)))
+	require.NoError(t, store.ClearLocksByLockID(context.Background(), "released"))
+
+	assert.Empty(t, lockedIDs(t, store, "expired"))
+	assert.Equal(t, ids(active), lockedIDs(t, store, "active"))
+	assert.Empty(t, lockedIDs(t, store, "released"))
+	assert.Equal(t, ids(expired, released), claim(t, store, "next", now(), outbox.PendingDelivery, 10))
+}
+
+func testStateTransitions(t *testing.T, factory Factory) {
+	store, db := factory(t)
+	rec := newRecord("key", now().Add(-time.Minute))
+	addRecords(t, store, db, rec)
+	claim(t, store, "lock", now(), outbox.PendingDelivery, 10)
+
+	tests := []struct {
+		state    outbox.RecordState
+		attempts int
+		err      string
+	}{
+		{state: outbox.PendingDelivery, attempts: 1, err: "failed"},
+		{state: outbox.MaxAttemptsReached, attempts: 2, err: "failed again"},
+		{state: outbox.DeadLettered, attempts: 2},
+		{state: outbox.Delivered, attempts: 3},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("state %v", tt.state), func(t *testing.T) {
+			records, err := store.GetRecordsByLockID(context.Background(), "lock")
+			require.NoError(t, err)
+			require.Len(t, records, 1)
+			updated := records[0]
+			attemptOn := now()
+			updated.State = tt.state
+			updated.NumberOfAttempts = tt.attempts
+			updated.LastAttemptOn = &attemptOn
+			updated.Error = nil
+			if tt.err != "" {
+				updated.Error = &tt.err
+			}
+			updated.ProcessedOn = nil
+			if tt.state == outbox.Delivered {
+				updated.ProcessedOn = &attemptOn
+			}
+
+			require.NoError(t, store.UpdateRecordByID(context.Background(), updated))
+
+			records, err = store.GetRecordsByLockID(context.Background(), "lock")
+			require.NoError(t, err)
+			require.Len(t, records, 1)
+			got := records[0]
+			assert.Equal(t, rec.ID, got.ID)
+			assert.Equal(t, rec.Message, got.Message)
+			assert.Equal(t, tt.state, got.State)
+			assert.Equal(t, tt.attempts, got.NumberOfAttempts)
+			assert.Equal(t, updated.Error, got.Error)
+			assert.True(t, rec.CreatedOn.Equal(got.CreatedOn), "created on should be kept")
+			require.NotNil(t, got.LastAttemptOn)
+			assert.True(t, attemptOn.Equal(*got.LastAttemptOn), "last attempt on should be updated")
+			assert.Equal(t, tt.state == outbox.Delivered, got.ProcessedOn != nil)
+		})
+	}
+
+	require.NoError(t, store.ClearLocksByLockID(context.Background(), "lock"))
+	assert.Empty(t, claim(t, store, "pending", now(), outbox.PendingDelivery, 10),
+		"records should only be claimed in their current state")
+	assert.Equal(t, ids(rec), claim(t, store, "delivered", now(), outbox.Delivered, 10))
+}
+
+func testRequeue(t *testing.T, factory Factory) {
+	store, db := factory(t)
+	errMsg := "broker unavailable"
+	failed := newRecord("", now().Add(-time.Minute))
+	delivered := newRecord("", now().Add(-time.Minute))
+	addRecords(t, store, db, failed, delivered)
+	claim(t, store, "lock", now(), outbox.PendingDelivery, 10)
+	failed.State = outbox.MaxAttemptsReached
+	failed.NumberOfAttempts = 3
+	failed.Error = &errMsg
+	delivered.State = outbox.Delivered
+	require.NoError(t, store.UpdateRecordByID(context.Background(), failed))
+	require.NoError(t, store.UpdateRecordByID(context.Background(), delivered))
+
+	n, err := store.RequeueRecords(context.Background(), outbox.RequeueFilter{
+		ErrorContains: "unavailable",
+		States:        []outbox.RecordState{outbox.MaxAttemptsReached},
+	}, "operator", now())
+
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Equal(t, ids(failed), claim(t, store, "requeued", now(), outbox.PendingDelivery, 10))
+	records, err := store.GetRecordsByLockID(context.Background(), "requeued")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, 0, records[0].NumberOfAttempts)
+	assert.Nil(t, records[0].Error)
+	require.NotNil(t, records[0].RequeuedBy)
+	assert.Equal(t, "operator", *records[0].RequeuedBy)
+}
+
+func testRetention(t *testing.T, factory Factory) {
+	store, db := factory(t)
+	expired := newRecord("", now().Add(-2*time.Hour))
+	kept := newRecord("", now().Add(-time.Minute))
+	addRecords(t, store, db, expired, kept)
+
+	require.NoError(t, store.RemoveRecordsBeforeDatetime(context.Background(), now().Add(-time.Hour)))
+
+	assert.Equal(t, ids(kept), claim(t, store, "lock", now(), outbox.PendingDelivery, 10))
+}
+
+func testConcurrentClaimers(t *testing.T, factory Factory) {
+	store, db := factory(t)
+	const records, claimers = 50, 5
+	createdOn := now().Add(-time.Hour)
+	for i := 0; i < records; i++ {
+		addRecords(t, store, db, newRecord("", createdOn.Add(time.Duration(i)*time.Second)))
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, claimers)
+	for i := 0; i < claimers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lockID := fmt.Sprintf("claimer-%d", i)
+			for n := 0; n < records; n++ {
+				if errs[i] = store.ClaimRecordsByState(context.Background(), lockID, now(), outbox.PendingDelivery, 3); errs[i] != nil {
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[uuid.UUID]string)
+	for i := 0; i < claimers; i++ {
+		require.NoError(t, errs[i])
+		lockID := fmt.Sprintf("claimer-%d", i)
+		for _, id := range lockedIDs(t, store, lockID) {
+			assert.Empty(t, seen[id], "record %v was claimed by %v and %v", id, seen[id], lockID)
+			seen[id] = lockID
+		}
+	}
+	assert.Len(t, seen, records, "every record should be claimed")
+}
@@ -1,6 +1,7 @@
 package outbox
 
 import (
+	"context"
 	"database/sql"
 	"time"
 
@@ -13,43 +14,61 @@ type MockStore struct {
 }
 
 // AddRecordTx method mock
-func (m *MockStore) AddRecordTx(record Record, tx *sql.Tx) error {
-	args := m.Called(record, tx)
+func (m *MockStore) AddRecordTx(ctx context.Context, record Record, tx *sql.Tx) error {
+	args := m.Called(ctx, record, tx)
 	return args.Error(0)
 }
 
 // GetRecordsByLockID method mock
-func (m *MockStore) GetRecordsByLockID(lockID string) ([]Record, error) {
-	args := m.Called(lockID)
+func (m *MockStore) GetRecordsByLockID(ctx context.Context, lockID string) ([]Record, error) {
+	args := m.Called(ctx, lockID)
 	return args.Get(0).([]Record), args.Error(1)
 }
 
 // UpdateRecordLockByState method mock
-func (m *MockStore) UpdateRecordLockByState(lockID string, lockedOn time.Time, state RecordState) error {
-	args := m.Called(lockID, lockedOn, state)
+func (m *MockStore) UpdateRecordLockByState(ctx context.Context, lockID string, lockedOn time.Time, state RecordState) error {
+	args := m.Called(ctx, lockID, lockedOn, state)
+	return args.Error(0)
+}
+
+// ClaimRecordsByState method mock
+func (m *MockStore) ClaimRecordsByState(ctx context.Context, lockID string, lockedOn time.Time, state RecordState, limit int) error {
+	args := m.Called(ctx, lockID, lockedOn, state, limit)
+	return args.Error(0)
+}
+
+// ClaimKeyOrderedRecordsByState method mock
+func (m *MockStore) ClaimKeyOrderedRecordsByState(ctx context.Context, lockID string, lockedOn time.Time, state RecordState, limit int) error {
+	args := m.Called(ctx, lockID, lockedOn, state, limit)
 	return args.Error(0)
 }
 
 // UpdateRecordByID method mock
-func (m *MockStore) UpdateRecordByID(message Record) error {
-	args := m.Called(message)
+func (m *MockStore) UpdateRecordByID(ctx context.Context, message Record) error {
+	args := m.Called(ctx, message)
 	return args.Error(0)
 }
 
 // ClearLocksWithDurationBeforeDate method mock
-func (m *MockStore) ClearLocksWithDurationBeforeDate(time time.Time) error {
-	args := m.Called(time)
+func (m *MockStore) ClearLocksWithDurationBeforeDate(ctx context.Context, time time.Time) error {
+	args := m.Called(ctx, time)
 	return args.Error(0)
 }
 
 // ClearLocksByLockID method mock
-func (m *MockStore) ClearLocksByLockID(lockID string) error {
-	args := m.Called(lockID)
+func (m *MockStore) ClearLocksByLockID(ctx context.Context, lockID string) error {
+	args := m.Called(ctx, lockID)
 	return args.Error(0)
 }
 
+// RequeueRecords method mock
+func (m *MockStore) RequeueRecords(ctx context.Context, filter RequeueFilter, requeuedBy string, requeuedOn time.Time) (int64, error) {
+	args := m.Called(ctx, filter, requeuedBy, requeuedOn)
+	return args.Get(0).(int64), args.Error(1)
+}
+
 // RemoveRecordsBeforeDatetime method mock
-func (m *MockStore) RemoveRecordsBeforeDatetime(expiryTime time.Time) error {
-	args := m.Called(expiryTime)
+func (m *MockStore) RemoveRecordsBeforeDatetime(ctx context.Context, expiryTime time.Time) error {
+	args := m.Called(ctx, expiryTime)
 	return args.Error(0)
 }